@@ -1,10 +1,17 @@
 package unionPayApp
 
 var SDKConfig = map[string]string{
-	"ContractApply":   "https://open.95516.com/open/access/1.0/contract.apply",
-	"ContractRelieve": "https://open.95516.com/open/access/1.0/contract.relieve",
-	"ContractInfo":    "https://open.95516.com/open/access/1.0/contract.info",
-	"PushMessage":     "https://open.95516.com/open/access/1.0/new.msg.push",
-	"OAuthToken":      "https://open.95516.com/open/access/1.0/token",
-	"OAuthMobile":     "https://open.95516.com/open/access/1.0/user.mobile",
+	"ContractApply":        "https://open.95516.com/open/access/1.0/contract.apply",
+	"ContractRelieve":      "https://open.95516.com/open/access/1.0/contract.relieve",
+	"ContractInfo":         "https://open.95516.com/open/access/1.0/contract.info",
+	"DeductionPay":         "https://open.95516.com/open/access/1.0/contract.pay",
+	"DeductionQuery":       "https://open.95516.com/open/access/1.0/contract.pay.query",
+	"DeductionClose":       "https://open.95516.com/open/access/1.0/contract.pay.close",
+	"DeductionRefund":      "https://open.95516.com/open/access/1.0/contract.refund",
+	"DeductionRefundQuery": "https://open.95516.com/open/access/1.0/contract.refund.query",
+	"PushMessage":          "https://open.95516.com/open/access/1.0/new.msg.push",
+	"OAuthToken":           "https://open.95516.com/open/access/1.0/token",
+	"OAuthRefresh":         "https://open.95516.com/open/access/1.0/refresh.token",
+	"OAuthMobile":          "https://open.95516.com/open/access/1.0/user.mobile",
+	"OAuthAuth":            "https://open.95516.com/open/access/1.0/user.auth",
 }
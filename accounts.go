@@ -1,5 +1,11 @@
 package unionPayApp
 
+import (
+	"context"
+	"html/template"
+	"time"
+)
+
 type accounts interface {
 	GetAccountById(string) (*UnionPayApp, error)
 }
@@ -32,6 +38,22 @@ func (u *Accounts) GetJsApiConfig(appId string, url string) (*JsApiConfig, error
 	return account.GetJsApiConfig(url)
 }
 
+func (u *Accounts) GetJsApiConfigWithOptions(appId string, url string, opts *JsApiConfigOptions) (*JsApiConfig, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.GetJsApiConfigWithOptions(url, opts)
+}
+
+func (u *Accounts) GetJsOAuthParams(appId string, params *OAuthCodeReq) (*JsOAuthParams, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.GetJsOAuthParams(params)
+}
+
 func (u *Accounts) GetOAuthCode(appId string, params *OAuthCodeReq) (string, error) {
 	account, err := u.Accounts.GetAccountById(appId)
 	if err != nil {
@@ -48,6 +70,14 @@ func (u *Accounts) GetOAuthToken(appId string, code string) (*OAuthToken, error)
 	return account.GetOAuthToken(code)
 }
 
+func (u *Accounts) GetOpenIdFromCode(appId string, code string) (string, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.GetOpenIdFromCode(code)
+}
+
 func (u *Accounts) GetOAuthMobile(appId string, params *OAuthMobileReq) (*OAuthMobile, error) {
 	account, err := u.Accounts.GetAccountById(appId)
 	if err != nil {
@@ -64,6 +94,22 @@ func (u *Accounts) GetOAuthMobileFromCode(appId string, code string) (*OAuthMobi
 	return account.GetOAuthMobileFromCode(code)
 }
 
+func (u *Accounts) GetOAuthAuth(appId string, params *OAuthAuthReq) (*OAuthAuth, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.GetOAuthAuth(params)
+}
+
+func (u *Accounts) GetOAuthAuthFromCode(appId string, code string) (*OAuthAuth, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.GetOAuthAuthFromCode(code)
+}
+
 func (u *Accounts) ContractCode(appId string, params *ContractCodeReq) (string, error) {
 	account, err := u.Accounts.GetAccountById(appId)
 	if err != nil {
@@ -95,3 +141,147 @@ func (u *Accounts) ContractInfo(appId string, params *ContractInfoReq) (*Contrac
 	}
 	return account.ContractInfo(params)
 }
+
+func (u *Accounts) GetValidAccessToken(ctx context.Context, appId string, openId string) (string, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.GetValidAccessToken(ctx, openId)
+}
+
+func (u *Accounts) IssueState(appId string, params *OAuthStateReq) (string, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.IssueState(params)
+}
+
+func (u *Accounts) VerifyState(ctx context.Context, appId string, state string) (*OAuthState, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.VerifyState(ctx, state)
+}
+
+func (u *Accounts) CreateDeduction(appId string, params *DeductionReq) (*Deduction, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.CreateDeduction(params)
+}
+
+func (u *Accounts) QueryDeduction(appId string, orderId string) (*Deduction, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.QueryDeduction(orderId)
+}
+
+func (u *Accounts) CloseDeduction(appId string, orderId string) (*Deduction, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.CloseDeduction(orderId)
+}
+
+func (u *Accounts) RefundDeduction(appId string, params *DeductionRefundReq) (*DeductionRefund, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.RefundDeduction(params)
+}
+
+func (u *Accounts) QueryDeductionRefund(appId string, refundId string) (*DeductionRefund, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.QueryDeductionRefund(refundId)
+}
+
+func (u *Accounts) GetPlanId(appId string, alias string) (string, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.GetPlanId(alias)
+}
+
+func (u *Accounts) CreateContractSession(ctx context.Context, appId string, params *ContractSessionReq) (*ContractSession, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.CreateContractSession(ctx, params)
+}
+
+func (u *Accounts) CompleteContractSession(ctx context.Context, appId string, code string, state string) (*ContractSession, *ContractApply, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account.CompleteContractSession(ctx, code, state)
+}
+
+func (u *Accounts) PushMessage(appId string, params *PushMessageReq) (*PushMessageResult, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.PushMessage(params)
+}
+
+func (u *Accounts) SendTemplate(ctx context.Context, appId string, openId string, name string, vars map[string]interface{}) (*PushMessageResult, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.SendTemplate(ctx, openId, name, vars)
+}
+
+func (u *Accounts) PushBatch(ctx context.Context, appId string, recipients <-chan *PushMessageReq, opts *PushBatchOptions) (*PushBatchSummary, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.PushBatch(ctx, recipients, opts)
+}
+
+func (u *Accounts) SchedulePush(ctx context.Context, appId string, at time.Time, msg *PushMessageReq) (string, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.PushQueue().Schedule(ctx, at, msg)
+}
+
+func (u *Accounts) CancelPush(ctx context.Context, appId string, id string) (bool, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return false, err
+	}
+	return account.PushQueue().Cancel(ctx, id)
+}
+
+func (u *Accounts) OutboxRelay(appId string, store OutboxStore) (*OutboxRelay, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.OutboxRelay(store), nil
+}
+
+func (u *Accounts) JsApiScript(appId string, pageUrl string, configOpts *JsApiConfigOptions, opts *JsApiScriptOptions) (template.HTML, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return "", err
+	}
+	return account.JsApiScript(pageUrl, configOpts, opts)
+}
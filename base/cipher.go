@@ -0,0 +1,108 @@
+package base
+
+import (
+	"bytes"
+	"crypto/des"
+	"encoding/base64"
+	"errors"
+	"github.com/forgoer/openssl"
+	"github.com/go-tron/crypto/desUtil"
+	"reflect"
+)
+
+var (
+	ErrorCipherKey     = errors.New("encryptKey must be 24 bytes")
+	ErrorCipherBase64  = errors.New("encrypted field is not valid base64")
+	ErrorCipherPadding = errors.New("encrypted field has bad padding")
+	ErrorCipherTarget  = errors.New("encrypted fields target must be a struct pointer")
+)
+
+// FieldCipher encrypts and decrypts UnionPay fields with 3DES-ECB and
+// PKCS5 padding, ciphertext is base64 encoded. Struct helpers only touch
+// string fields tagged upa:"encrypt".
+type FieldCipher struct {
+	Key []byte
+}
+
+func NewFieldCipher(key []byte) *FieldCipher {
+	return &FieldCipher{Key: key}
+}
+
+func (c *FieldCipher) Encrypt(value string) (string, error) {
+	if len(c.Key) != 24 {
+		return "", ErrorCipherKey
+	}
+	dst, err := desUtil.Des3ECBEncrypt([]byte(value), c.Key, openssl.PKCS5_PADDING)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(dst), nil
+}
+
+func (c *FieldCipher) Decrypt(value string) (string, error) {
+	if len(c.Key) != 24 {
+		return "", ErrorCipherKey
+	}
+	src, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", ErrorCipherBase64
+	}
+	if len(src) == 0 || len(src)%des.BlockSize != 0 {
+		return "", ErrorCipherPadding
+	}
+	dst, err := desUtil.Des3ECBDecrypt(src, c.Key, "")
+	if err != nil {
+		return "", err
+	}
+	n := int(dst[len(dst)-1])
+	if n == 0 || n > des.BlockSize || !bytes.Equal(dst[len(dst)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return "", ErrorCipherPadding
+	}
+	return string(dst[:len(dst)-n]), nil
+}
+
+func (c *FieldCipher) EncryptStruct(v interface{}) error {
+	return c.walk(v, c.Encrypt)
+}
+
+func (c *FieldCipher) DecryptStruct(v interface{}) error {
+	return c.walk(v, c.Decrypt)
+}
+
+func (c *FieldCipher) walk(v interface{}, fn func(string) (string, error)) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrorCipherTarget
+	}
+	return walkStruct(rv.Elem(), fn)
+}
+
+func walkStruct(rv reflect.Value, fn func(string) (string, error)) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rv.Field(i)
+		if !rt.Field(i).IsExported() {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String && rt.Field(i).Tag.Get("upa") == "encrypt":
+			if field.String() == "" {
+				continue
+			}
+			value, err := fn(field.String())
+			if err != nil {
+				return err
+			}
+			field.SetString(value)
+		case field.Kind() == reflect.Struct:
+			if err := walkStruct(field, fn); err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Ptr && !field.IsNil() && field.Elem().Kind() == reflect.Struct:
+			if err := walkStruct(field.Elem(), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -112,6 +112,10 @@ type FrontTokenRes struct {
 	} `json:"params"`
 }
 
+func (upa *UnionPayApp) FieldCipher() *FieldCipher {
+	return NewFieldCipher(upa.encryptKeyByte)
+}
+
 func (upa *UnionPayApp) Sign(req map[string]interface{}) {
 	req["timestamp"] = fmt.Sprint(localTime.Now().Unix())
 	req["nonceStr"] = random.String(16)
@@ -22,6 +22,34 @@ var base = UnionPayApp{
 	},
 }
 
+func TestFieldCipher(t *testing.T) {
+	cipher := NewFieldCipher([]byte("2ab34a731cae9d7629d3868f"))
+	type card struct {
+		Name   string `upa:"encrypt"`
+		CardNo string `upa:"encrypt"`
+		Bank   string
+	}
+	c := &card{Name: "张三", CardNo: "6222000011112222", Bank: "ICBC"}
+	if err := cipher.EncryptStruct(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name == "张三" || c.Bank != "ICBC" {
+		t.Fatal("unexpected fields", c)
+	}
+	if err := cipher.DecryptStruct(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "张三" || c.CardNo != "6222000011112222" {
+		t.Fatal("unexpected fields", c)
+	}
+	if _, err := cipher.Decrypt("not base64"); err != ErrorCipherBase64 {
+		t.Fatal(err)
+	}
+	if _, err := NewFieldCipher([]byte("short")).Encrypt("x"); err != ErrorCipherKey {
+		t.Fatal(err)
+	}
+}
+
 func TestGetBackendToken(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
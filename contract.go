@@ -1,18 +1,93 @@
 package unionPayApp
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/google/go-querystring/query"
 )
 
+const ContractApplyPrefix = "upa-contract-apply:"
+
+// ContractApplyDuplicateCodes are resp codes known to mean the contractCode
+// was applied already. A rejected ContractApply is answered with the
+// original result when ContractInfo shows the contract opened with the same
+// contractCode, or opened without a contractCode for one of these codes.
+var ContractApplyDuplicateCodes = []string{}
+
+type ContractStatus string
+
 const (
-	ContractStatusNotOpen  = "0"
-	ContractStatusOpened   = "1"
-	ContractStatusRelieved = "3"
+	ContractStatusNotOpen  ContractStatus = "0"
+	ContractStatusOpened   ContractStatus = "1"
+	ContractStatusRelieved ContractStatus = "3"
 )
 
+var contractStatusNames = map[ContractStatus]string{
+	ContractStatusNotOpen:  "NotOpen",
+	ContractStatusOpened:   "Opened",
+	ContractStatusRelieved: "Relieved",
+}
+
+func (s ContractStatus) String() string {
+	if name, ok := contractStatusNames[s]; ok {
+		return name
+	}
+	return "Unknown(" + string(s) + ")"
+}
+
+func (s ContractStatus) IsKnown() bool {
+	_, ok := contractStatusNames[s]
+	return ok
+}
+
+// orNotOpen maps the empty status returned for a user without a contract
+// to ContractStatusNotOpen.
+func (s ContractStatus) orNotOpen() ContractStatus {
+	if s == "" {
+		return ContractStatusNotOpen
+	}
+	return s
+}
+
+func (s ContractStatus) IsActive() bool {
+	return s == ContractStatusOpened
+}
+
+func (s ContractStatus) IsTerminated() bool {
+	return s == ContractStatusRelieved
+}
+
+func (s ContractStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(s))
+}
+
+// UnmarshalJSON accepts the status as a string or a number, unknown values
+// are kept as they are.
+func (s *ContractStatus) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case nil:
+		*s = ""
+	case string:
+		*s = ContractStatus(value)
+	case json.Number:
+		*s = ContractStatus(value.String())
+	default:
+		return ErrorParam("contractStatus")
+	}
+	return nil
+}
+
 type ContractCodeReq struct {
-	Uri   string `json:"uri"`
-	State string `json:"state"`
+	Uri    string `json:"uri"`
+	State  string `json:"state"`
+	PlanId string `json:"planId"`
 }
 
 type ContractCodeQuery struct {
@@ -32,7 +107,7 @@ func (upa *UnionPayApp) ContractCode(params *ContractCodeReq) (string, error) {
 		ResponseType: "code",
 		Scope:        "upapi_contract",
 		State:        params.State,
-		PlanId:       upa.PlanId,
+		PlanId:       upa.planId(params.PlanId),
 	}
 	if upa.OAuthRedirectUri != "" {
 		req.RedirectUri = upa.OAuthRedirectUri + req.RedirectUri
@@ -49,6 +124,7 @@ type ContractApplyReq struct {
 	OpenId       string `json:"openId"`
 	AccessToken  string `json:"accessToken"`
 	ContractCode string `json:"contractCode"`
+	PlanId       string `json:"planId"`
 }
 
 type ContractApply struct {
@@ -58,23 +134,87 @@ type ContractApply struct {
 }
 
 func (upa *UnionPayApp) ContractApply(params *ContractApplyReq) (*ContractApply, error) {
+	var result = &ContractApply{}
+	apply := func() error {
+		res, err := upa.contractApply(params)
+		if err != nil {
+			return err
+		}
+		*result = *res
+		return nil
+	}
+	var err error
+	if params.ContractCode == "" {
+		err = apply()
+	} else {
+		// the code comes from the page, a repeat by another user or plan must
+		// not get the stored result
+		err = upa.idempotent(ContractApplyPrefix, upa.planId(params.PlanId)+":"+params.OpenId+":"+params.ContractCode, result, apply)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upa.updateContractRegistry(func(ctx context.Context, r *ContractRegistry) error {
+		_, err := r.Transition(ctx, &ContractRecord{
+			OpenId:         params.OpenId,
+			PlanId:         upa.planId(params.PlanId),
+			ContractId:     result.ContractId,
+			ContractCode:   result.ContractCode,
+			ContractStatus: ContractStatusOpened,
+		})
+		return err
+	})
+	return result, nil
+}
+
+func (upa *UnionPayApp) contractApply(params *ContractApplyReq) (*ContractApply, error) {
 	res, err := upa.Request("ContractApply", map[string]interface{}{
 		"appId":        upa.AppId,
 		"accessToken":  params.AccessToken,
 		"openId":       params.OpenId,
-		"planId":       upa.PlanId,
+		"planId":       upa.planId(params.PlanId),
 		"contractCode": params.ContractCode,
 	}, &ContractApply{})
-	if err != nil {
+	if err == nil {
+		return res.(*ContractApply), nil
+	}
+	if params.ContractCode == "" || RespCode(err) == "" {
+		return nil, err
+	}
+
+	info, infoErr := upa.contractInfo(&ContractInfoReq{
+		OpenId: params.OpenId,
+		PlanId: params.PlanId,
+	})
+	if infoErr != nil || !info.ContractStatus.IsActive() {
+		return nil, err
+	}
+	if info.ContractCode != params.ContractCode && !(info.ContractCode == "" && isContractApplyDuplicate(err)) {
 		return nil, err
 	}
-	return res.(*ContractApply), nil
+	return &ContractApply{
+		ContractCode: params.ContractCode,
+		ContractId:   info.ContractId,
+		OperateTime:  info.SignTime,
+	}, nil
+}
+
+func isContractApplyDuplicate(err error) bool {
+	code := RespCode(err)
+	for _, c := range ContractApplyDuplicateCodes {
+		if code == c {
+			return true
+		}
+	}
+	return false
 }
 
 type ContractRelieveReq struct {
 	OpenId       string `json:"openId"`
 	ContractId   string `json:"contractId"`
 	ContractCode string `json:"contractCode"`
+	PlanId       string `json:"planId"`
 }
 
 type ContractRelieve struct {
@@ -86,30 +226,95 @@ func (upa *UnionPayApp) ContractRelieve(params *ContractRelieveReq) (*ContractRe
 	res, err := upa.Request("ContractRelieve", map[string]interface{}{
 		"appId":        upa.AppId,
 		"openId":       params.OpenId,
-		"planId":       upa.PlanId,
+		"planId":       upa.planId(params.PlanId),
 		"contractId":   params.ContractId,
 		"contractCode": params.ContractCode,
 	}, &ContractRelieve{})
 	if err != nil {
 		return nil, err
 	}
-	return res.(*ContractRelieve), nil
+	result := res.(*ContractRelieve)
+	upa.updateContractRegistry(func(ctx context.Context, r *ContractRegistry) error {
+		_, err := r.Transition(ctx, &ContractRecord{
+			OpenId:         params.OpenId,
+			PlanId:         upa.planId(params.PlanId),
+			ContractId:     params.ContractId,
+			ContractStatus: ContractStatusRelieved,
+		})
+		return err
+	})
+	return result, nil
 }
 
 type ContractInfoReq struct {
 	OpenId string `json:"openId"`
+	PlanId string `json:"planId"`
 }
 
 type ContractInfo struct {
-	ContractId     string `json:"contractId"`
-	ContractStatus string `json:"contractStatus"`
+	ContractId     string                 `json:"contractId"`
+	ContractStatus ContractStatus         `json:"contractStatus"`
+	ContractCode   string                 `json:"contractCode"`
+	PlanId         string                 `json:"planId"`
+	SignTime       string                 `json:"signTime"`
+	RelieveTime    string                 `json:"relieveTime"`
+	CardNo         string                 `json:"cardNo"`
+	Extra          map[string]interface{} `json:"extra,omitempty"`
+}
+
+var contractInfoFields = []string{"contractId", "contractStatus", "contractCode", "planId", "signTime", "relieveTime", "cardNo"}
+
+// UnmarshalJSON keeps the fields ContractInfo does not know in Extra.
+func (c *ContractInfo) UnmarshalJSON(data []byte) error {
+	type contractInfo ContractInfo
+	var info contractInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	info.Extra = extraFields(fields, contractInfoFields)
+	*c = ContractInfo(info)
+	return nil
+}
+
+// extraFields drops the known fields of a response and returns the others,
+// with the ones nested in "extra" moved to the top, or nil when none is left.
+func extraFields(fields map[string]interface{}, known []string) map[string]interface{} {
+	for _, name := range known {
+		delete(fields, name)
+	}
+	if extra, ok := fields["extra"].(map[string]interface{}); ok {
+		delete(fields, "extra")
+		for k, v := range extra {
+			fields[k] = v
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
 }
 
 func (upa *UnionPayApp) ContractInfo(params *ContractInfoReq) (*ContractInfo, error) {
+	result, err := upa.contractInfo(params)
+	if err != nil {
+		return nil, err
+	}
+	upa.updateContractRegistry(func(ctx context.Context, r *ContractRegistry) error {
+		_, err := r.sync(ctx, upa.planId(params.PlanId), params.OpenId, result)
+		return err
+	})
+	return result, nil
+}
+
+func (upa *UnionPayApp) contractInfo(params *ContractInfoReq) (*ContractInfo, error) {
 	res, err := upa.Request("ContractInfo", map[string]interface{}{
 		"appId":  upa.AppId,
 		"openId": params.OpenId,
-		"planId": upa.PlanId,
+		"planId": upa.planId(params.PlanId),
 	}, &ContractInfo{})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,259 @@
+package unionPayApp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/types/mapUtil"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ContractNotifyPrefix     = "upa-contract-notify:"
+	ContractNotifyLockPrefix = "upa-contract-notify-lock:"
+)
+
+var (
+	// ContractNotifyTTL is how long a handled notification is remembered for
+	// deduplication.
+	ContractNotifyTTL = time.Hour * 24 * 7
+	// ContractNotifyLockTTL bounds the handlers of one notification, a retry
+	// arriving meanwhile is answered with a failure so UnionPay sends it again.
+	ContractNotifyLockTTL = time.Minute
+)
+
+var (
+	ErrorNotifySignature = baseError.System("3114", "云闪付通知验签失败")
+	ErrorNotifyBody      = baseError.System("3115", "云闪付通知解析失败")
+)
+
+type ContractNotify struct {
+	AppId          string         `json:"appId"`
+	OpenId         string         `json:"openId"`
+	PlanId         string         `json:"planId"`
+	ContractId     string         `json:"contractId"`
+	ContractCode   string         `json:"contractCode"`
+	ContractStatus ContractStatus `json:"contractStatus"`
+	OperateTime    string         `json:"operateTime"`
+}
+
+type ContractSigned ContractNotify
+
+type ContractRelieved ContractNotify
+
+// ContractNotifyHandler receives the notifications UnionPay sends when a
+// contract is signed or relieved on the UnionPay side. The signature is
+// checked with PublicKey when set, otherwise with the app secret. A
+// notification is acknowledged once its handlers succeeded, repeated ones
+// are acknowledged without running them again. Notifications that can never
+// be handled, with a bad signature, body or appId, are refused with 400 so
+// UnionPay does not send them again, and ones in a status without handlers
+// are acknowledged.
+type ContractNotifyHandler struct {
+	App       *UnionPayApp
+	PublicKey *rsa.PublicKey
+	signed    []func(ctx context.Context, event *ContractSigned) error
+	relieved  []func(ctx context.Context, event *ContractRelieved) error
+}
+
+func (h *ContractNotifyHandler) OnSigned(fn func(ctx context.Context, event *ContractSigned) error) {
+	h.signed = append(h.signed, fn)
+}
+
+func (h *ContractNotifyHandler) OnRelieved(fn func(ctx context.Context, event *ContractRelieved) error) {
+	h.relieved = append(h.relieved, fn)
+}
+
+// notifyInvalid marks a notification that fails the same way every time it
+// is sent.
+type notifyInvalid struct {
+	error
+}
+
+func (h *ContractNotifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.handle(r)
+	if err != nil {
+		h.App.Logger.Error("ContractNotify", h.App.Logger.Field("error", err), h.App.Logger.Field("appId", h.App.AppId))
+	}
+	var invalid notifyInvalid
+	if errors.As(err, &invalid) {
+		writeNotifyAck(w, http.StatusBadRequest, "99", invalid.Error())
+		return
+	}
+	WriteNotifyAck(w, err)
+}
+
+func (h *ContractNotifyHandler) handle(r *http.Request) error {
+	data, err := readNotify(r)
+	if err != nil {
+		return notifyInvalid{err}
+	}
+	if err := h.App.VerifyNotify(data, h.PublicKey); err != nil {
+		return notifyInvalid{err}
+	}
+
+	var notify = &ContractNotify{}
+	if err := mapUtil.ToStruct(data, notify); err != nil {
+		return notifyInvalid{ErrorNotifyBody}
+	}
+	if notify.AppId != h.App.AppId {
+		return notifyInvalid{ErrorParam("appId")}
+	}
+	h.App.Logger.Info("ContractNotify",
+		h.App.Logger.Field("openId", notify.OpenId),
+		h.App.Logger.Field("contractId", notify.ContractId),
+		h.App.Logger.Field("contractStatus", notify.ContractStatus))
+
+	ctx := r.Context()
+	id := h.App.AppId + ":" + notify.ContractId + ":" + notify.OperateTime
+	done, err := h.App.Redis.Exists(ctx, ContractNotifyPrefix+id).Result()
+	if err != nil {
+		return err
+	}
+	if done != 0 {
+		return nil
+	}
+
+	secret, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	lockKey := ContractNotifyLockPrefix + id
+	if !h.App.Redis.LockWithSecret(ctx, lockKey, secret, int(ContractNotifyLockTTL/time.Second)) {
+		return ErrorProcessing(notify.ContractId)
+	}
+	defer h.App.Redis.UnlockWithSecret(context.Background(), lockKey, secret)
+
+	// the delivery holding the lock before us may have finished meanwhile
+	done, err = h.App.Redis.Exists(ctx, ContractNotifyPrefix+id).Result()
+	if err != nil {
+		return err
+	}
+	if done != 0 {
+		return nil
+	}
+
+	if err := h.dispatch(ctx, notify); err != nil {
+		return err
+	}
+	return h.App.Redis.Set(ctx, ContractNotifyPrefix+id, 1, ContractNotifyTTL).Err()
+}
+
+func (h *ContractNotifyHandler) dispatch(ctx context.Context, notify *ContractNotify) error {
+	switch notify.ContractStatus {
+	case ContractStatusOpened:
+		for _, fn := range h.signed {
+			if err := fn(ctx, (*ContractSigned)(notify)); err != nil {
+				return err
+			}
+		}
+	case ContractStatusRelieved:
+		for _, fn := range h.relieved {
+			if err := fn(ctx, (*ContractRelieved)(notify)); err != nil {
+				return err
+			}
+		}
+	default:
+		h.App.Logger.Info("ContractNotify",
+			h.App.Logger.Field("openId", notify.OpenId),
+			h.App.Logger.Field("contractId", notify.ContractId),
+			h.App.Logger.Field("unhandled", notify.ContractStatus))
+	}
+	return nil
+}
+
+// VerifyNotify checks the signature of a notification sent by UnionPay,
+// with SHA256withRSA when publicKey is set and the app secret otherwise.
+func (upa *UnionPayApp) VerifyNotify(data map[string]interface{}, publicKey *rsa.PublicKey) error {
+	signature, _ := data["signature"].(string)
+	if signature == "" {
+		return ErrorNotifySignature
+	}
+
+	var req = make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k == "signature" {
+			continue
+		}
+		req[k] = v
+	}
+
+	if publicKey != nil {
+		sign, err := base64.StdEncoding.DecodeString(signature)
+		if err != nil {
+			return ErrorNotifySignature
+		}
+		hashed := sha256.Sum256([]byte(mapUtil.ToSortString(req)))
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], sign); err != nil {
+			return ErrorNotifySignature
+		}
+		return nil
+	}
+
+	req["secret"] = upa.Secret
+	hashed := sha256.Sum256([]byte(mapUtil.ToSortString(req)))
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(hex.EncodeToString(hashed[:]))) != 1 {
+		return ErrorNotifySignature
+	}
+	return nil
+}
+
+func readNotify(r *http.Request) (map[string]interface{}, error) {
+	var data = make(map[string]interface{})
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			return nil, ErrorNotifyBody
+		}
+		for k := range r.PostForm {
+			data[k] = r.PostForm.Get(k)
+		}
+		return data, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, ErrorNotifyBody
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, ErrorNotifyBody
+	}
+	for k, v := range data {
+		if n, ok := v.(json.Number); ok {
+			data[k] = n.String()
+		}
+	}
+	return data, nil
+}
+
+// WriteNotifyAck writes the acknowledgement UnionPay expects, a non nil err
+// asks UnionPay to send the notification again and should only be passed
+// for failures that may not happen again, such as an unavailable store.
+func WriteNotifyAck(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeNotifyAck(w, http.StatusInternalServerError, "99", err.Error())
+		return
+	}
+	writeNotifyAck(w, http.StatusOK, "00", "success")
+}
+
+func writeNotifyAck(w http.ResponseWriter, status int, resp string, msg string) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"resp": resp,
+		"msg":  msg,
+	})
+}
@@ -0,0 +1,322 @@
+package unionPayApp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ReconcileMatched  = "matched"
+	ReconcileMismatch = "mismatch"
+	ReconcileMissing  = "missing"
+	ReconcileError    = "error"
+)
+
+type ReconcileItem struct {
+	AppId    string         `json:"appId"`
+	OpenId   string         `json:"openId"`
+	PlanId   string         `json:"planId"`
+	Expected ContractStatus `json:"expected"`
+}
+
+type ReconcileEntry struct {
+	ReconcileItem
+	Result     string         `json:"result"`
+	Actual     ContractStatus `json:"actual"`
+	ContractId string         `json:"contractId"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	Total      int               `json:"total"`
+	Matched    int               `json:"matched"`
+	Mismatches []*ReconcileEntry `json:"mismatches"`
+	Missing    []*ReconcileEntry `json:"missing"`
+	Errors     []*ReconcileEntry `json:"errors"`
+}
+
+type ReconcileProgress struct {
+	Done       int `json:"done"`
+	Matched    int `json:"matched"`
+	Mismatched int `json:"mismatched"`
+	Missing    int `json:"missing"`
+	Failed     int `json:"failed"`
+}
+
+// ReconcileCheckpoint is what a reconciliation saves to resume from, Offset
+// counts the leading items of the stream already in Report. Completed is
+// set once the whole stream is reconciled, the next run starts over.
+type ReconcileCheckpoint struct {
+	Offset    int              `json:"offset"`
+	Report    *ReconcileReport `json:"report"`
+	Completed bool             `json:"completed,omitempty"`
+}
+
+type ReconcileCheckpointStore interface {
+	Load(ctx context.Context) (*ReconcileCheckpoint, error)
+	Save(ctx context.Context, checkpoint *ReconcileCheckpoint) error
+}
+
+type FileCheckpoint struct {
+	Path string
+}
+
+func (f *FileCheckpoint) Load(ctx context.Context) (*ReconcileCheckpoint, error) {
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint = &ReconcileCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+func (f *FileCheckpoint) Save(ctx context.Context, checkpoint *ReconcileCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+type ReconcileOptions struct {
+	Concurrency     int
+	RatePerSecond   int
+	Checkpoint      ReconcileCheckpointStore
+	CheckpointEvery int
+	Progress        func(progress *ReconcileProgress)
+}
+
+type reconcileJob struct {
+	seq   int
+	item  *ReconcileItem
+	entry *ReconcileEntry
+}
+
+// ReconcileContracts compares the expected contract status of every item
+// with ContractInfo. Results are added to the report in stream order so a
+// checkpoint always covers a prefix of the stream.
+func (u *Accounts) ReconcileContracts(ctx context.Context, items <-chan *ReconcileItem, opts *ReconcileOptions) (*ReconcileReport, error) {
+	if opts == nil {
+		opts = &ReconcileOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	checkpointEvery := opts.CheckpointEvery
+	if checkpointEvery <= 0 {
+		checkpointEvery = 100
+	}
+
+	var checkpoint = &ReconcileCheckpoint{Report: &ReconcileReport{}}
+	if opts.Checkpoint != nil {
+		saved, err := opts.Checkpoint.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil && saved.Report != nil && !saved.Completed {
+			checkpoint = saved
+		}
+	}
+	report := checkpoint.Report
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var limiter <-chan time.Time
+	if opts.RatePerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.RatePerSecond))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	jobs := make(chan *reconcileJob)
+	results := make(chan *reconcileJob)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if limiter != nil {
+					select {
+					case <-limiter:
+					case <-ctx.Done():
+						return
+					}
+				}
+				job.entry = u.reconcile(job.item)
+				results <- job
+			}
+		}()
+	}
+
+	// drained is written before jobs is closed and read after results is
+	// closed, so it needs no lock
+	skip := checkpoint.Offset
+	drained := false
+	go func() {
+		defer close(jobs)
+		seq := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case item, ok := <-items:
+				if !ok {
+					drained = true
+					return
+				}
+				seq++
+				if seq <= skip {
+					continue
+				}
+				select {
+				case jobs <- &reconcileJob{seq: seq, item: item}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		pending  = make(map[int]*ReconcileEntry)
+		saved    = checkpoint.Offset
+		saveErr  error
+		progress = &ReconcileProgress{
+			Done:       report.Total,
+			Matched:    report.Matched,
+			Mismatched: len(report.Mismatches),
+			Missing:    len(report.Missing),
+			Failed:     len(report.Errors),
+		}
+	)
+	for job := range results {
+		pending[job.seq] = job.entry
+		for {
+			entry, ok := pending[checkpoint.Offset+1]
+			if !ok {
+				break
+			}
+			delete(pending, checkpoint.Offset+1)
+			checkpoint.Offset++
+			report.add(entry, progress)
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		if opts.Checkpoint != nil && saveErr == nil && checkpoint.Offset-saved >= checkpointEvery {
+			if saveErr = opts.Checkpoint.Save(ctx, checkpoint); saveErr != nil {
+				cancel()
+			}
+			saved = checkpoint.Offset
+		}
+	}
+	if saveErr != nil {
+		return report, saveErr
+	}
+
+	checkpoint.Completed = drained && ctx.Err() == nil
+	if opts.Checkpoint != nil && (checkpoint.Offset != saved || checkpoint.Completed) {
+		if err := opts.Checkpoint.Save(context.Background(), checkpoint); err != nil {
+			return report, err
+		}
+	}
+	return report, ctx.Err()
+}
+
+// reconcile only reads ContractInfo, unlike ContractInfo it leaves the
+// contract registry alone.
+func (u *Accounts) reconcile(item *ReconcileItem) *ReconcileEntry {
+	entry := &ReconcileEntry{ReconcileItem: *item}
+	info, err := u.contractInfo(item.AppId, &ContractInfoReq{
+		OpenId: item.OpenId,
+		PlanId: item.PlanId,
+	})
+	if err != nil {
+		entry.Result = ReconcileError
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Actual = info.ContractStatus.orNotOpen()
+	entry.ContractId = info.ContractId
+	switch {
+	case info.ContractId == "" && item.Expected.orNotOpen() != ContractStatusNotOpen:
+		entry.Result = ReconcileMissing
+	case entry.Actual != item.Expected.orNotOpen():
+		entry.Result = ReconcileMismatch
+	default:
+		entry.Result = ReconcileMatched
+	}
+	return entry
+}
+
+func (u *Accounts) contractInfo(appId string, params *ContractInfoReq) (*ContractInfo, error) {
+	account, err := u.Accounts.GetAccountById(appId)
+	if err != nil {
+		return nil, err
+	}
+	return account.contractInfo(params)
+}
+
+func (r *ReconcileReport) add(entry *ReconcileEntry, progress *ReconcileProgress) {
+	r.Total++
+	progress.Done++
+	switch entry.Result {
+	case ReconcileMatched:
+		r.Matched++
+		progress.Matched++
+	case ReconcileMismatch:
+		r.Mismatches = append(r.Mismatches, entry)
+		progress.Mismatched++
+	case ReconcileMissing:
+		r.Missing = append(r.Missing, entry)
+		progress.Missing++
+	default:
+		r.Errors = append(r.Errors, entry)
+		progress.Failed++
+	}
+}
+
+func (r *ReconcileReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func (r *ReconcileReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"result", "appId", "openId", "planId", "expected", "actual", "contractId", "error"}); err != nil {
+		return err
+	}
+	for _, list := range [][]*ReconcileEntry{r.Mismatches, r.Missing, r.Errors} {
+		for _, e := range list {
+			if err := writer.Write([]string{e.Result, e.AppId, e.OpenId, e.PlanId, string(e.Expected), string(e.Actual), e.ContractId, e.Error}); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
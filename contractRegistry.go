@@ -0,0 +1,259 @@
+package unionPayApp
+
+import (
+	"context"
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"github.com/go-tron/redis"
+	"strconv"
+	"sync"
+)
+
+const ContractRecordPrefix = "upa-contract:"
+
+var (
+	ErrorContractTransition = baseError.SystemFactory("3116", "云闪付签约状态无法从{}变更为{}")
+	ErrorContractConflict   = baseError.System("3124", "云闪付签约状态并发更新冲突")
+)
+
+// ContractSaveAttempts is how often a change is tried again when another
+// change of the same contract was saved in between.
+var ContractSaveAttempts = 5
+
+// contractStoreSave saves the record in KEYS[1] only when the stored one is
+// still at the version in ARGV[2], a missing record is version 0.
+var contractStoreSave = redis.NewScript(`
+local data = redis.call('GET', KEYS[1])
+local version = 0
+if data then
+	version = cjson.decode(data).version or 0
+end
+if tostring(version) ~= ARGV[2] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+var contractTransitions = map[ContractStatus][]ContractStatus{
+	ContractStatusNotOpen:  {ContractStatusOpened},
+	ContractStatusOpened:   {ContractStatusRelieved},
+	ContractStatusRelieved: {ContractStatusOpened},
+}
+
+// CanContractTransition reports whether a contract may move from one status
+// to another. A status outside the state machine, such as the undocumented
+// "2", may move to any status so such a record is never stuck.
+func CanContractTransition(from ContractStatus, to ContractStatus) bool {
+	if from == to || !from.IsKnown() {
+		return true
+	}
+	for _, status := range contractTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+type ContractRecord struct {
+	AppId          string         `json:"appId"`
+	OpenId         string         `json:"openId"`
+	PlanId         string         `json:"planId"`
+	ContractId     string         `json:"contractId"`
+	ContractCode   string         `json:"contractCode"`
+	ContractStatus ContractStatus `json:"contractStatus"`
+	UpdatedAt      int64          `json:"updatedAt"`
+	Version        int64          `json:"version"`
+}
+
+// ContractStore keeps contract records. CompareAndSave stores record only
+// when the stored record is still at version, a missing record being at 0,
+// and reports whether it did. record already carries the next Version.
+type ContractStore interface {
+	Get(ctx context.Context, appId string, planId string, openId string) (*ContractRecord, error)
+	CompareAndSave(ctx context.Context, record *ContractRecord, version int64) (bool, error)
+}
+
+type MemoryContractStore struct {
+	lock    sync.Mutex
+	records map[string]ContractRecord
+}
+
+func NewMemoryContractStore() *MemoryContractStore {
+	return &MemoryContractStore{
+		records: make(map[string]ContractRecord),
+	}
+}
+
+func (s *MemoryContractStore) Get(ctx context.Context, appId string, planId string, openId string) (*ContractRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.records[appId+":"+planId+":"+openId]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (s *MemoryContractStore) CompareAndSave(ctx context.Context, record *ContractRecord, version int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := record.AppId + ":" + record.PlanId + ":" + record.OpenId
+	if s.records[key].Version != version {
+		return false, nil
+	}
+	s.records[key] = *record
+	return true, nil
+}
+
+type RedisContractStore struct {
+	Redis *redis.Redis
+}
+
+func (s *RedisContractStore) Get(ctx context.Context, appId string, planId string, openId string) (*ContractRecord, error) {
+	data, err := s.Redis.Get(ctx, ContractRecordPrefix+appId+":"+planId+":"+openId).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record = &ContractRecord{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *RedisContractStore) CompareAndSave(ctx context.Context, record *ContractRecord, version int64) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	key := ContractRecordPrefix + record.AppId + ":" + record.PlanId + ":" + record.OpenId
+	saved, err := contractStoreSave.Run(ctx, s.Redis, []string{key}, string(data), strconv.FormatInt(version, 10)).Int()
+	if err != nil {
+		return false, err
+	}
+	return saved == 1, nil
+}
+
+// ContractRegistry keeps the local copy of user contracts, changes go
+// through the contract state machine except when syncing from ContractInfo.
+type ContractRegistry struct {
+	App   *UnionPayApp
+	Store ContractStore
+}
+
+// ContractRegistry returns nil when Config.ContractStore is not set.
+func (upa *UnionPayApp) ContractRegistry() *ContractRegistry {
+	if upa.ContractStore == nil {
+		return nil
+	}
+	return &ContractRegistry{
+		App:   upa,
+		Store: upa.ContractStore,
+	}
+}
+
+func (r *ContractRegistry) Get(ctx context.Context, planId string, openId string) (*ContractRecord, error) {
+	record, err := r.Store.Get(ctx, r.App.AppId, planId, openId)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record = &ContractRecord{
+			AppId:          r.App.AppId,
+			OpenId:         openId,
+			PlanId:         planId,
+			ContractStatus: ContractStatusNotOpen,
+		}
+	}
+	return record, nil
+}
+
+func (r *ContractRegistry) Transition(ctx context.Context, change *ContractRecord) (*ContractRecord, error) {
+	return r.update(ctx, change.PlanId, change.OpenId, func(record *ContractRecord) (*ContractRecord, error) {
+		if !CanContractTransition(record.ContractStatus, change.ContractStatus) {
+			return nil, ErrorContractTransition(record.ContractStatus, change.ContractStatus)
+		}
+		return change, nil
+	})
+}
+
+func (r *ContractRegistry) Sync(ctx context.Context, openId string) (*ContractRecord, error) {
+	return r.SyncPlan(ctx, "", openId)
+}
+
+func (r *ContractRegistry) SyncPlan(ctx context.Context, planId string, openId string) (*ContractRecord, error) {
+	info, err := r.App.contractInfo(&ContractInfoReq{
+		OpenId: openId,
+		PlanId: planId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.sync(ctx, r.App.planId(planId), openId, info)
+}
+
+func (r *ContractRegistry) sync(ctx context.Context, planId string, openId string, info *ContractInfo) (*ContractRecord, error) {
+	status := info.ContractStatus.orNotOpen()
+	return r.update(ctx, planId, openId, func(record *ContractRecord) (*ContractRecord, error) {
+		if !CanContractTransition(record.ContractStatus, status) {
+			r.App.Logger.Info("ContractRegistry.Sync",
+				r.App.Logger.Field("openId", openId),
+				r.App.Logger.Field("local", record.ContractStatus),
+				r.App.Logger.Field("remote", status))
+		}
+		return &ContractRecord{
+			ContractId:     info.ContractId,
+			ContractStatus: status,
+		}, nil
+	})
+}
+
+// update applies the change fn returns for the stored record. When another
+// change was saved in between, the record is read again and fn checks the
+// change against it.
+func (r *ContractRegistry) update(ctx context.Context, planId string, openId string, fn func(record *ContractRecord) (*ContractRecord, error)) (*ContractRecord, error) {
+	for i := 0; i < ContractSaveAttempts; i++ {
+		record, err := r.Get(ctx, planId, openId)
+		if err != nil {
+			return nil, err
+		}
+		change, err := fn(record)
+		if err != nil {
+			return nil, err
+		}
+		version := record.Version
+		if change.ContractId != "" {
+			record.ContractId = change.ContractId
+		}
+		if change.ContractCode != "" {
+			record.ContractCode = change.ContractCode
+		}
+		record.ContractStatus = change.ContractStatus
+		record.UpdatedAt = localTime.Now().Unix()
+		record.Version = version + 1
+		saved, err := r.Store.CompareAndSave(ctx, record, version)
+		if err != nil {
+			return nil, err
+		}
+		if saved {
+			return record, nil
+		}
+	}
+	return nil, ErrorContractConflict
+}
+
+func (upa *UnionPayApp) updateContractRegistry(fn func(ctx context.Context, r *ContractRegistry) error) {
+	r := upa.ContractRegistry()
+	if r == nil {
+		return
+	}
+	if err := fn(context.Background(), r); err != nil {
+		upa.Logger.Error("ContractRegistry", upa.Logger.Field("error", err), upa.Logger.Field("appId", upa.AppId))
+	}
+}
@@ -0,0 +1,154 @@
+package unionPayApp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"github.com/go-tron/redis"
+	"math/big"
+	"time"
+)
+
+const ContractSessionPrefix = "upa-contract-session:"
+
+// ContractSessionTTL is how long a signing session waits for the redirect.
+var ContractSessionTTL = time.Minute * 30
+
+var (
+	ErrorContractSession       = baseError.System("3120", "云闪付签约会话不存在或已过期")
+	ErrorContractSessionOpenId = baseError.System("3121", "云闪付签约用户与会话不一致")
+)
+
+// NewContractCode returns a 32 digit contractCode, a second timestamp
+// followed by 18 random digits.
+func NewContractCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e18))
+	if err != nil {
+		return "", err
+	}
+	return localTime.Now().Format("20060102150405") + leftPad(n.String(), 18), nil
+}
+
+func leftPad(s string, n int) string {
+	for len(s) < n {
+		s = "0" + s
+	}
+	return s
+}
+
+type ContractSessionReq struct {
+	OpenId string `json:"openId"`
+	PlanId string `json:"planId"`
+	BizRef string `json:"bizRef"`
+	Uri    string `json:"uri"`
+}
+
+// ContractSession is kept until it expires, Result holds the ContractApply
+// of the first completed redirect.
+type ContractSession struct {
+	ContractCode string         `json:"contractCode"`
+	OpenId       string         `json:"openId"`
+	PlanId       string         `json:"planId"`
+	BizRef       string         `json:"bizRef"`
+	Uri          string         `json:"uri"`
+	Url          string         `json:"url"`
+	ExpiresAt    int64          `json:"expiresAt"`
+	Result       *ContractApply `json:"result,omitempty"`
+}
+
+// CreateContractSession generates a contractCode, keeps it with the openId,
+// plan and business reference and builds the signing url. The contractCode
+// travels as the state of the signing redirect.
+func (upa *UnionPayApp) CreateContractSession(ctx context.Context, params *ContractSessionReq) (*ContractSession, error) {
+	contractCode, err := NewContractCode()
+	if err != nil {
+		return nil, err
+	}
+	session := &ContractSession{
+		ContractCode: contractCode,
+		OpenId:       params.OpenId,
+		PlanId:       upa.planId(params.PlanId),
+		BizRef:       params.BizRef,
+		Uri:          params.Uri,
+		ExpiresAt:    localTime.Now().Add(ContractSessionTTL).Unix(),
+	}
+	session.Url, err = upa.ContractCode(&ContractCodeReq{
+		Uri:    params.Uri,
+		State:  contractCode,
+		PlanId: session.PlanId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := upa.saveContractSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// saveContractSession stores session until its ExpiresAt.
+func (upa *UnionPayApp) saveContractSession(ctx context.Context, session *ContractSession) error {
+	ttl := time.Until(time.Unix(session.ExpiresAt, 0))
+	if ttl <= 0 {
+		return ErrorContractSession
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return upa.Redis.Set(ctx, ContractSessionPrefix+upa.AppId+":"+session.ContractCode, string(data), ttl).Err()
+}
+
+func (upa *UnionPayApp) GetContractSession(ctx context.Context, contractCode string) (*ContractSession, error) {
+	data, err := upa.Redis.Get(ctx, ContractSessionPrefix+upa.AppId+":"+contractCode).Result()
+	if err == redis.Nil {
+		return nil, ErrorContractSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session = &ContractSession{}
+	if err := json.Unmarshal([]byte(data), session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CompleteContractSession finishes ContractApply for the code and state of
+// the signing redirect. A repeated redirect gets the stored result, its code
+// is not exchanged again.
+func (upa *UnionPayApp) CompleteContractSession(ctx context.Context, code string, state string) (*ContractSession, *ContractApply, error) {
+	session, err := upa.GetContractSession(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.Result != nil {
+		return session, session.Result, nil
+	}
+	token, err := upa.GetOAuthToken(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.OpenId != "" && session.OpenId != token.OpenId {
+		return nil, nil, ErrorContractSessionOpenId
+	}
+
+	res, err := upa.ContractApply(&ContractApplyReq{
+		OpenId:       token.OpenId,
+		AccessToken:  token.AccessToken,
+		ContractCode: session.ContractCode,
+		PlanId:       session.PlanId,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	session.OpenId = token.OpenId
+	session.Result = res
+	if err := upa.saveContractSession(ctx, session); err != nil {
+		upa.Logger.Error("CompleteContractSession", upa.Logger.Field("error", err), upa.Logger.Field("openId", token.OpenId))
+	}
+	return session, res, nil
+}
@@ -0,0 +1,236 @@
+package unionPayApp
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/types/mapUtil"
+	"net/http"
+	"strconv"
+)
+
+const DeductionPrefix = "upa-deduction:"
+
+var (
+	ErrorDeductionConflict = baseError.SystemFactory("3118", "云闪付订单{}参数与已提交订单不一致")
+)
+
+// Fen is an amount in fen, UnionPay sends it either as a number or a string.
+type Fen int64
+
+func (f Fen) Yuan() string {
+	return fmt.Sprintf("%d.%02d", f/100, f%100)
+}
+
+func (f Fen) String() string {
+	return strconv.FormatInt(int64(f), 10)
+}
+
+func (f *Fen) UnmarshalJSON(data []byte) error {
+	if string(data) == `""` || string(data) == "null" {
+		*f = 0
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	v, err := n.Int64()
+	if err != nil {
+		return err
+	}
+	*f = Fen(v)
+	return nil
+}
+
+type DeductionReq struct {
+	OpenId     string `json:"openId"`
+	ContractId string `json:"contractId"`
+	PlanId     string `json:"planId"`
+	OrderId    string `json:"orderId"`
+	Amount     Fen    `json:"amount"`
+	Subject    string `json:"subject"`
+	NotifyUrl  string `json:"notifyUrl"`
+}
+
+type Deduction struct {
+	OrderId     string `json:"orderId"`
+	ContractId  string `json:"contractId"`
+	QueryId     string `json:"queryId"`
+	Amount      Fen    `json:"txnAmt"`
+	OrderStatus string `json:"orderStatus"`
+	TxnTime     string `json:"txnTime"`
+}
+
+func (upa *UnionPayApp) CreateDeduction(params *DeductionReq) (*Deduction, error) {
+	if params.OrderId == "" {
+		return nil, ErrorParam("orderId")
+	}
+	if params.ContractId == "" {
+		return nil, ErrorParam("contractId")
+	}
+	if params.Amount <= 0 {
+		return nil, ErrorParam("amount")
+	}
+
+	var result = &Deduction{}
+	err := upa.idempotent(DeductionPrefix, "pay:"+params.OrderId, result, func() error {
+		_, err := upa.Request("DeductionPay", map[string]interface{}{
+			"appId":      upa.AppId,
+			"openId":     params.OpenId,
+			"planId":     upa.planId(params.PlanId),
+			"contractId": params.ContractId,
+			"orderId":    params.OrderId,
+			"txnAmt":     params.Amount.String(),
+			"orderDesc":  params.Subject,
+			"backUrl":    params.NotifyUrl,
+		}, result)
+		if err != nil {
+			return err
+		}
+		if result.OrderId == "" {
+			result.OrderId = params.OrderId
+		}
+		if result.ContractId == "" {
+			result.ContractId = params.ContractId
+		}
+		if result.Amount == 0 {
+			result.Amount = params.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.ContractId != params.ContractId || result.Amount != params.Amount {
+		return nil, ErrorDeductionConflict(params.OrderId)
+	}
+	return result, nil
+}
+
+func (upa *UnionPayApp) QueryDeduction(orderId string) (*Deduction, error) {
+	res, err := upa.Request("DeductionQuery", map[string]interface{}{
+		"appId":   upa.AppId,
+		"orderId": orderId,
+	}, &Deduction{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Deduction), nil
+}
+
+func (upa *UnionPayApp) CloseDeduction(orderId string) (*Deduction, error) {
+	res, err := upa.Request("DeductionClose", map[string]interface{}{
+		"appId":   upa.AppId,
+		"orderId": orderId,
+	}, &Deduction{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Deduction), nil
+}
+
+type DeductionRefundReq struct {
+	OrderId   string `json:"orderId"`
+	RefundId  string `json:"refundId"`
+	Amount    Fen    `json:"amount"`
+	Reason    string `json:"reason"`
+	NotifyUrl string `json:"notifyUrl"`
+}
+
+type DeductionRefund struct {
+	OrderId      string `json:"orderId"`
+	RefundId     string `json:"refundId"`
+	QueryId      string `json:"queryId"`
+	Amount       Fen    `json:"txnAmt"`
+	RefundStatus string `json:"refundStatus"`
+	TxnTime      string `json:"txnTime"`
+}
+
+func (upa *UnionPayApp) RefundDeduction(params *DeductionRefundReq) (*DeductionRefund, error) {
+	if params.OrderId == "" {
+		return nil, ErrorParam("orderId")
+	}
+	if params.RefundId == "" {
+		return nil, ErrorParam("refundId")
+	}
+	if params.Amount <= 0 {
+		return nil, ErrorParam("amount")
+	}
+
+	var result = &DeductionRefund{}
+	err := upa.idempotent(DeductionPrefix, "refund:"+params.RefundId, result, func() error {
+		_, err := upa.Request("DeductionRefund", map[string]interface{}{
+			"appId":    upa.AppId,
+			"orderId":  params.OrderId,
+			"refundId": params.RefundId,
+			"txnAmt":   params.Amount.String(),
+			"reason":   params.Reason,
+			"backUrl":  params.NotifyUrl,
+		}, result)
+		if err != nil {
+			return err
+		}
+		if result.OrderId == "" {
+			result.OrderId = params.OrderId
+		}
+		if result.RefundId == "" {
+			result.RefundId = params.RefundId
+		}
+		if result.Amount == 0 {
+			result.Amount = params.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.OrderId != params.OrderId || result.Amount != params.Amount {
+		return nil, ErrorDeductionConflict(params.RefundId)
+	}
+	return result, nil
+}
+
+func (upa *UnionPayApp) QueryDeductionRefund(refundId string) (*DeductionRefund, error) {
+	res, err := upa.Request("DeductionRefundQuery", map[string]interface{}{
+		"appId":    upa.AppId,
+		"refundId": refundId,
+	}, &DeductionRefund{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*DeductionRefund), nil
+}
+
+type DeductionNotify struct {
+	AppId       string `json:"appId"`
+	OpenId      string `json:"openId"`
+	ContractId  string `json:"contractId"`
+	OrderId     string `json:"orderId"`
+	RefundId    string `json:"refundId"`
+	QueryId     string `json:"queryId"`
+	Amount      Fen    `json:"txnAmt"`
+	OrderStatus string `json:"orderStatus"`
+	TxnTime     string `json:"txnTime"`
+}
+
+// ParseDeductionNotify reads and verifies a payment result notification,
+// reply with WriteNotifyAck once it has been handled.
+func (upa *UnionPayApp) ParseDeductionNotify(r *http.Request, publicKey *rsa.PublicKey) (*DeductionNotify, error) {
+	data, err := readNotify(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := upa.VerifyNotify(data, publicKey); err != nil {
+		return nil, err
+	}
+	var notify = &DeductionNotify{}
+	if err := mapUtil.ToStruct(data, notify); err != nil {
+		return nil, ErrorNotifyBody
+	}
+	if notify.AppId != upa.AppId {
+		return nil, ErrorParam("appId")
+	}
+	return notify, nil
+}
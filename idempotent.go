@@ -0,0 +1,78 @@
+package unionPayApp
+
+import (
+	"context"
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/redis"
+	"time"
+)
+
+const IdempotentLockPrefix = "upa-idempotent-lock:"
+
+var (
+	// IdempotentTTL is how long a result is kept for repeated calls.
+	IdempotentTTL = time.Hour * 24
+	// IdempotentWait is how long a repeated call waits for the first one.
+	IdempotentWait = time.Second * 10
+	// IdempotentLockTTL bounds a call, it should outlast the request timeout.
+	IdempotentLockTTL = time.Second * 30
+)
+
+var (
+	ErrorProcessing = baseError.SystemFactory("3117", "云闪付请求{}处理中")
+)
+
+// idempotent runs fn once per id, calls with the same id wait for the
+// running one and get its stored result.
+func (upa *UnionPayApp) idempotent(prefix string, id string, result interface{}, fn func() error) error {
+	ctx := context.Background()
+	key := prefix + upa.AppId + ":" + id
+	lockKey := IdempotentLockPrefix + prefix + upa.AppId + ":" + id
+	deadline := time.Now().Add(IdempotentWait)
+	secret, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	for {
+		found, err := upa.idempotentResult(ctx, key, result)
+		if err != nil || found {
+			return err
+		}
+		if upa.Redis.LockWithSecret(ctx, lockKey, secret, int(IdempotentLockTTL/time.Second)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrorProcessing(id)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	defer upa.Redis.UnlockWithSecret(ctx, lockKey, secret)
+
+	// the holder before us may have stored the result between our read and
+	// the lock
+	if found, err := upa.idempotentResult(ctx, key, result); err != nil || found {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return upa.Redis.Set(ctx, key, string(body), IdempotentTTL).Err()
+}
+
+func (upa *UnionPayApp) idempotentResult(ctx context.Context, key string, result interface{}) (bool, error) {
+	data, err := upa.Redis.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(data), result)
+}
@@ -1,37 +1,256 @@
 package unionPayApp
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/go-tron/local-time"
-	"github.com/go-tron/random"
+	"github.com/go-tron/redis"
+	"math/big"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const JsApiConfigPrefix = "upa-jsapi-config:"
+
+// JsApiNonceLength is the nonceStr length when the options set none.
+var JsApiNonceLength = 16
+
+// JsApiConfig is the argument of upsdk.config. Url and SignString are only
+// set with JsApiConfigOptions.SignString to debug signatures on the server,
+// SignString contains the frontToken and must never reach a page.
 type JsApiConfig struct {
-	Debug     bool   `json:"debug"`
-	AppId     string `json:"appId"`
-	Timestamp int64  `json:"timestamp"`
-	NonceStr  string `json:"nonceStr"`
-	Signature string `json:"signature"`
+	Debug      bool     `json:"debug"`
+	AppId      string   `json:"appId"`
+	Timestamp  int64    `json:"timestamp"`
+	NonceStr   string   `json:"nonceStr"`
+	Signature  string   `json:"signature"`
+	JsApiList  []string `json:"jsApiList"`
+	Url        string   `json:"url,omitempty"`
+	SignString string   `json:"signString,omitempty"`
+}
+
+// JsApiConfigOptions completes GetJsApiConfig. Debug turns on the debug
+// mode of upsdk in addition to Config.JsApiDebug. SignString returns the
+// signed url and string for logging on the server. With CacheFor a config
+// signed for the same url and frontToken is reused for that long.
+type JsApiConfigOptions struct {
+	Debug       bool
+	SignString  bool
+	JsApiList   []string
+	NonceLength int
+	CacheFor    time.Duration
 }
 
-func (upa *UnionPayApp) GetJsApiConfig(url string) (*JsApiConfig, error) {
+func (upa *UnionPayApp) GetJsApiConfig(rawUrl string) (*JsApiConfig, error) {
+	return upa.GetJsApiConfigWithOptions(rawUrl, nil)
+}
+
+func (upa *UnionPayApp) GetJsApiConfigWithOptions(rawUrl string, opts *JsApiConfigOptions) (*JsApiConfig, error) {
+	if opts == nil {
+		opts = &JsApiConfigOptions{}
+	}
+	pageUrl, err := NormalizeJsApiUrl(rawUrl)
+	if err != nil {
+		return nil, err
+	}
 
 	frontToken, err := upa.GetFrontToken()
 	if err != nil {
 		return nil, err
 	}
 
-	jsApiConfig := &JsApiConfig{
-		AppId:     upa.AppId,
-		Timestamp: localTime.Now().Unix(),
-		NonceStr:  random.String(10),
-		Signature: "",
+	var cacheKey string
+	var jsApiConfig *JsApiConfig
+	if opts.CacheFor > 0 {
+		cacheKey = JsApiConfigPrefix + upa.AppId + ":" + jsApiSignature(frontToken.FrontToken+"\n"+pageUrl)
+		jsApiConfig, err = upa.cachedJsApiConfig(cacheKey)
+		if err != nil {
+			upa.Logger.Error("GetJsApiConfig", upa.Logger.Field("error", err), upa.Logger.Field("url", pageUrl))
+		}
 	}
-	var signStr = "appId=" + jsApiConfig.AppId + "&frontToken=" + frontToken.FrontToken + "&nonceStr=" + jsApiConfig.NonceStr + "&timestamp=" + strconv.FormatInt(jsApiConfig.Timestamp, 10) + "&url=" + url
+	if jsApiConfig == nil {
+		nonceLength := opts.NonceLength
+		if nonceLength <= 0 {
+			nonceLength = JsApiNonceLength
+		}
+		nonceStr, err := randomNonce(nonceLength)
+		if err != nil {
+			return nil, err
+		}
+		jsApiConfig = &JsApiConfig{
+			AppId:     upa.AppId,
+			Timestamp: localTime.Now().Unix(),
+			NonceStr:  nonceStr,
+		}
+		jsApiConfig.Signature = jsApiSignature(JsApiSignString(jsApiConfig.AppId, frontToken.FrontToken, jsApiConfig.NonceStr, jsApiConfig.Timestamp, pageUrl))
+		if cacheKey != "" {
+			if data, err := json.Marshal(jsApiConfig); err == nil {
+				if err := upa.Redis.Set(context.Background(), cacheKey, string(data), opts.CacheFor).Err(); err != nil {
+					upa.Logger.Error("GetJsApiConfig", upa.Logger.Field("error", err), upa.Logger.Field("url", pageUrl))
+				}
+			}
+		}
+	}
+
+	jsApiConfig.Debug = opts.Debug || upa.JsApiDebug
+	if opts.SignString {
+		jsApiConfig.Url = pageUrl
+		jsApiConfig.SignString = JsApiSignString(jsApiConfig.AppId, frontToken.FrontToken, jsApiConfig.NonceStr, jsApiConfig.Timestamp, pageUrl)
+	}
+	jsApiConfig.JsApiList = opts.JsApiList
+	if jsApiConfig.JsApiList == nil {
+		jsApiConfig.JsApiList = []string{}
+	}
+	return jsApiConfig, nil
+}
+
+// public returns a copy of the config without Url and SignString, as served
+// to pages.
+func (c *JsApiConfig) public() *JsApiConfig {
+	public := *c
+	public.Url = ""
+	public.SignString = ""
+	return &public
+}
+
+func (upa *UnionPayApp) cachedJsApiConfig(key string) (*JsApiConfig, error) {
+	data, err := upa.Redis.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jsApiConfig = &JsApiConfig{}
+	if err := json.Unmarshal([]byte(data), jsApiConfig); err != nil {
+		return nil, err
+	}
+	return jsApiConfig, nil
+}
+
+const nonceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// randomNonce returns n alphanumeric characters from crypto/rand.
+func randomNonce(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(nonceChars)))
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = nonceChars[c.Int64()]
+	}
+	return string(b), nil
+}
+
+func JsApiSignString(appId string, frontToken string, nonceStr string, timestamp int64, pageUrl string) string {
+	return "appId=" + appId + "&frontToken=" + frontToken + "&nonceStr=" + nonceStr + "&timestamp=" + strconv.FormatInt(timestamp, 10) + "&url=" + pageUrl
+}
+
+func jsApiSignature(signStr string) string {
 	hash := sha256.New()
 	hash.Write([]byte(signStr))
-	jsApiConfig.Signature = hex.EncodeToString(hash.Sum(nil))
-	return jsApiConfig, nil
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// VerifyJsApiSignature recomputes the signature of a JsApiConfig issued for
+// pageUrl with frontToken, the url is normalised like GetJsApiConfig does.
+func VerifyJsApiSignature(config *JsApiConfig, frontToken string, pageUrl string) bool {
+	normalized, err := NormalizeJsApiUrl(pageUrl)
+	if err != nil {
+		return false
+	}
+	signature := jsApiSignature(JsApiSignString(config.AppId, frontToken, config.NonceStr, config.Timestamp, normalized))
+	return subtle.ConstantTimeCompare([]byte(signature), []byte(strings.ToLower(config.Signature))) == 1
+}
+
+// NormalizeJsApiUrl turns rawUrl into the form upsdk signs, the page url
+// without the fragment. Scheme and host are lower cased, the default port
+// is dropped and the query is escaped the way browsers do, keeping the order
+// of the parameters since the page checks against its own location.
+func NormalizeJsApiUrl(rawUrl string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return "", ErrorParam("url")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", ErrorParam("url")
+	}
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "https" && u.Port() == "443") || (u.Scheme == "http" && u.Port() == "80") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.RawQuery = canonicalQuery(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// canonicalQuery escapes the query like a browser does for http and https
+// pages, the special-query percent-encode set of the WHATWG URL standard:
+// controls, space, double and single quote, '#', '<', '>' and non ascii.
+// Existing escapes are kept as written.
+func canonicalQuery(query string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c <= ' ' || c > '~' || c == '"' || c == '#' || c == '<' || c == '>' || c == '\'':
+			sb.WriteByte('%')
+			sb.WriteByte(hexDigits[c>>4])
+			sb.WriteByte(hexDigits[c&15])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+type JsOAuthParams struct {
+	AppId string `json:"appId"`
+	Scope string `json:"scope"`
+	State string `json:"state,omitempty"`
+}
+
+// GetJsOAuthParams builds the parameters of upsdk.appletAuth for pages that
+// can not redirect to GetOAuthCode. The code comes back to the page, so Uri
+// does not apply. Entry defaults to OAuthEntryMini, the parameters are the
+// ones of the entry in OAuthEntries.
+func (upa *UnionPayApp) GetJsOAuthParams(params *OAuthCodeReq) (*JsOAuthParams, error) {
+	if params.Scope == "" {
+		return nil, ErrorParam("scope")
+	}
+	entry := params.Entry
+	if entry == "" {
+		entry = OAuthEntryMini
+	}
+	config := OAuthEntries[entry]
+	if config == nil {
+		return nil, ErrorParam("entry")
+	}
+	res := &JsOAuthParams{}
+	for _, name := range config.Params {
+		switch name {
+		case "appId":
+			res.AppId = upa.AppId
+		case "scope":
+			res.Scope = string(params.Scope)
+		case "state":
+			res.State = params.State
+		}
+	}
+	return res, nil
 }
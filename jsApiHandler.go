@@ -0,0 +1,114 @@
+package unionPayApp
+
+import (
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrorJsApiDomain = baseError.System("3123", "云闪付JS-SDK页面域名不在白名单")
+)
+
+type jsApiConfigReq struct {
+	AppId string `json:"appId"`
+	Url   string `json:"url"`
+}
+
+// JsApiConfigHandler serves the argument of upsdk.config for the appId and
+// url of the query or of a JSON body. AllowedDomains lists per appId the
+// hosts pages may be served from, an entry starting with "." also allows
+// its subdomains. Cross origin requests are allowed from the same hosts.
+// Options sets jsApiList, debug and caching of the served config, Url and
+// SignString are never served.
+type JsApiConfigHandler struct {
+	Accounts       *Accounts
+	AllowedDomains map[string][]string
+	Options        *JsApiConfigOptions
+}
+
+func (h *JsApiConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := &jsApiConfigReq{
+		AppId: r.URL.Query().Get("appId"),
+		Url:   r.URL.Query().Get("url"),
+	}
+	var bodyErr error
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		bodyErr = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(params)
+	}
+	h.setCORS(w, r, params.AppId)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if bodyErr != nil {
+		writeJsApiError(w, http.StatusBadRequest, ErrorParam("body"))
+		return
+	}
+
+	if params.AppId == "" {
+		writeJsApiError(w, http.StatusBadRequest, ErrorParam("appId"))
+		return
+	}
+	pageUrl, err := url.Parse(params.Url)
+	if err != nil || params.Url == "" {
+		writeJsApiError(w, http.StatusBadRequest, ErrorParam("url"))
+		return
+	}
+	if !matchHost(pageUrl.Hostname(), h.AllowedDomains[params.AppId]) {
+		writeJsApiError(w, http.StatusForbidden, ErrorJsApiDomain)
+		return
+	}
+
+	config, err := h.Accounts.GetJsApiConfigWithOptions(params.AppId, params.Url, h.Options)
+	if err != nil {
+		writeJsApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(config.public())
+}
+
+// setCORS allows the origin when its host is allowed for appId, or for any
+// app when appId is not known yet as in a preflight request.
+func (h *JsApiConfigHandler) setCORS(w http.ResponseWriter, r *http.Request, appId string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return
+	}
+	allowed := false
+	if appId != "" {
+		allowed = matchHost(u.Hostname(), h.AllowedDomains[appId])
+	} else {
+		for _, domains := range h.AllowedDomains {
+			if matchHost(u.Hostname(), domains) {
+				allowed = true
+				break
+			}
+		}
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if !allowed {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	header.Set("Access-Control-Allow-Headers", "Content-Type")
+	header.Set("Access-Control-Max-Age", "600")
+}
+
+func writeJsApiError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": err.Error(),
+	})
+}
@@ -0,0 +1,101 @@
+package unionPayApp
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// JsApiSdkUrl is the upsdk script loaded when the options set none.
+var JsApiSdkUrl = "https://open.95516.com/s/open/js/upsdk.js"
+
+// JsApiScriptOptions configures the bootstrap script. Ready and Error name
+// global functions, e.g. "app.onReady", called by upsdk.pluginReady and
+// with the error of upsdk.error. Nonce is the CSP nonce of both tags.
+type JsApiScriptOptions struct {
+	SdkUrl string
+	Nonce  string
+	Ready  string
+	Error  string
+}
+
+var jsCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][\w$]*(\.[A-Za-z_$][\w$]*)*$`)
+
+var jsApiScriptTemplate = template.Must(template.New("upsdk").Parse(
+	`<script src="{{.SdkUrl}}"{{with .Nonce}} nonce="{{.}}"{{end}}></script>
+<script{{with .Nonce}} nonce="{{.}}"{{end}}>
+upsdk.config({{.Config}});
+{{- with .Ready}}
+upsdk.pluginReady(function () { {{.}}(); });
+{{- end}}
+{{- with .Error}}
+upsdk.error(function (err) { {{.}}(err); });
+{{- end}}
+</script>`))
+
+// JsApiScript renders the script tags loading upsdk and calling
+// upsdk.config with config, leaving out Url and SignString.
+func JsApiScript(config *JsApiConfig, opts *JsApiScriptOptions) (template.HTML, error) {
+	if opts == nil {
+		opts = &JsApiScriptOptions{}
+	}
+	data := struct {
+		SdkUrl string
+		Nonce  string
+		Config *JsApiConfig
+		Ready  template.JS
+		Error  template.JS
+	}{
+		SdkUrl: opts.SdkUrl,
+		Nonce:  opts.Nonce,
+		Config: config.public(),
+	}
+	if data.SdkUrl == "" {
+		data.SdkUrl = JsApiSdkUrl
+	}
+	for _, callback := range []struct {
+		name   string
+		target *template.JS
+	}{{opts.Ready, &data.Ready}, {opts.Error, &data.Error}} {
+		if callback.name == "" {
+			continue
+		}
+		if !jsCallbackPattern.MatchString(callback.name) {
+			return "", ErrorParam("callback")
+		}
+		*callback.target = template.JS(callback.name)
+	}
+
+	var sb strings.Builder
+	if err := jsApiScriptTemplate.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return template.HTML(sb.String()), nil
+}
+
+// JsApiFuncMap provides upsdkScript to html/template pages, taking the
+// config and optionally the CSP nonce of the request:
+// {{upsdkScript .JsApiConfig .CspNonce}}.
+func JsApiFuncMap(opts *JsApiScriptOptions) template.FuncMap {
+	return template.FuncMap{
+		"upsdkScript": func(config *JsApiConfig, nonce ...string) (template.HTML, error) {
+			o := JsApiScriptOptions{}
+			if opts != nil {
+				o = *opts
+			}
+			if len(nonce) != 0 {
+				o.Nonce = nonce[0]
+			}
+			return JsApiScript(config, &o)
+		},
+	}
+}
+
+// JsApiScript signs pageUrl and renders the bootstrap script for it.
+func (upa *UnionPayApp) JsApiScript(pageUrl string, configOpts *JsApiConfigOptions, opts *JsApiScriptOptions) (template.HTML, error) {
+	config, err := upa.GetJsApiConfigWithOptions(pageUrl, configOpts)
+	if err != nil {
+		return "", err
+	}
+	return JsApiScript(config, opts)
+}
@@ -1,20 +1,51 @@
 package unionPayApp
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 type PushMessageReq struct {
 	OpenId  string `json:"openId"`
 	Content string `json:"content"`
 	Url     string `json:"url"`
 }
 
-func (upa *UnionPayApp) PushMessage(params *PushMessageReq) (map[string]interface{}, error) {
+// PushMessageResult is the response of PushMessage. MsgId is filled when the
+// platform returns one, the other response fields are kept in Extra.
+type PushMessageResult struct {
+	MsgId string                 `json:"msgId"`
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// UnmarshalJSON keeps the fields PushMessageResult does not know in Extra.
+func (p *PushMessageResult) UnmarshalJSON(data []byte) error {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	p.MsgId = ""
+	switch v := fields["msgId"].(type) {
+	case string:
+		p.MsgId = v
+	case json.Number:
+		p.MsgId = v.String()
+	}
+	p.Extra = extraFields(fields, []string{"msgId"})
+	return nil
+}
+
+func (upa *UnionPayApp) PushMessage(params *PushMessageReq) (*PushMessageResult, error) {
 	res, err := upa.Request("PushMessage", map[string]interface{}{
 		"appId":   upa.AppId,
 		"openId":  params.OpenId,
 		"content": params.Content,
 		"url":     params.Url,
-	}, &map[string]interface{}{})
+	}, &PushMessageResult{})
 	if err != nil {
 		return nil, err
 	}
-	return *res.(*map[string]interface{}), nil
+	return res.(*PushMessageResult), nil
 }
@@ -0,0 +1,290 @@
+package unionPayApp
+
+import (
+	"context"
+	"fmt"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MessageContentMaxLength is the longest content PushMessage accepts, in
+// characters.
+var MessageContentMaxLength = 100
+
+var (
+	ErrorTemplate = baseError.SystemFactory("3122", "云闪付消息模板错误:{}")
+)
+
+type TemplateVarType string
+
+const (
+	TemplateVarString TemplateVarType = "string"
+	TemplateVarInt    TemplateVarType = "int"
+	TemplateVarAmount TemplateVarType = "amount"
+	TemplateVarTime   TemplateVarType = "time"
+)
+
+type MessageTemplateLocale struct {
+	Content string `json:"content"`
+	Url     string `json:"url"`
+}
+
+// MessageTemplate is rendered with text/template, Vars declares every
+// variable the template takes. The output of every action of Url is query
+// escaped. An empty Content or Url of a locale falls back to the default.
+type MessageTemplate struct {
+	Name    string                            `json:"name"`
+	Content string                            `json:"content"`
+	Url     string                            `json:"url"`
+	Vars    map[string]TemplateVarType        `json:"vars"`
+	Locales map[string]*MessageTemplateLocale `json:"locales"`
+}
+
+type compiledTemplate struct {
+	vars    map[string]TemplateVarType
+	content map[string]*template.Template
+	url     map[string]*template.Template
+}
+
+type MessageTemplateRegistry struct {
+	AllowedHosts []string
+	lock         sync.RWMutex
+	templates    map[string]*compiledTemplate
+}
+
+func NewMessageTemplateRegistry(allowedHosts ...string) *MessageTemplateRegistry {
+	return &MessageTemplateRegistry{
+		AllowedHosts: allowedHosts,
+		templates:    make(map[string]*compiledTemplate),
+	}
+}
+
+func (r *MessageTemplateRegistry) Register(t *MessageTemplate) error {
+	if t.Name == "" {
+		return ErrorTemplate("name")
+	}
+	compiled := &compiledTemplate{
+		vars:    t.Vars,
+		content: make(map[string]*template.Template),
+		url:     make(map[string]*template.Template),
+	}
+	locales := map[string]*MessageTemplateLocale{"": {Content: t.Content, Url: t.Url}}
+	for locale, l := range t.Locales {
+		locales[locale] = l
+	}
+	for locale, l := range locales {
+		if l.Content != "" || locale == "" {
+			content, err := template.New(t.Name).Option("missingkey=error").Parse(l.Content)
+			if err != nil {
+				return ErrorTemplate(err)
+			}
+			compiled.content[locale] = content
+		}
+		if l.Url != "" {
+			u, err := template.New(t.Name).Option("missingkey=error").Parse(l.Url)
+			if err != nil {
+				return ErrorTemplate(err)
+			}
+			queryEscapeActions(u.Tree.Root)
+			compiled.url[locale] = u
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.templates == nil {
+		r.templates = make(map[string]*compiledTemplate)
+	}
+	r.templates[t.Name] = compiled
+	return nil
+}
+
+// Render renders the template for locale, falling back to the default
+// variant, and validates the result against the PushMessage rules.
+func (r *MessageTemplateRegistry) Render(name string, locale string, vars map[string]interface{}) (*PushMessageReq, error) {
+	r.lock.RLock()
+	t := r.templates[name]
+	r.lock.RUnlock()
+	if t == nil {
+		return nil, ErrorTemplate("模板不存在 " + name)
+	}
+	if err := checkTemplateVars(t.vars, vars); err != nil {
+		return nil, err
+	}
+
+	content := t.content[locale]
+	if content == nil {
+		content = t.content[""]
+	}
+	urlTemplate := t.url[locale]
+	if urlTemplate == nil {
+		urlTemplate = t.url[""]
+	}
+
+	var req = &PushMessageReq{}
+	var sb strings.Builder
+	if err := content.Execute(&sb, vars); err != nil {
+		return nil, ErrorTemplate(err)
+	}
+	req.Content = sb.String()
+	if urlTemplate != nil {
+		sb.Reset()
+		if err := urlTemplate.Execute(&sb, vars); err != nil {
+			return nil, ErrorTemplate(err)
+		}
+		req.Url = sb.String()
+	}
+
+	if err := ValidateMessageContent(req.Content); err != nil {
+		return nil, err
+	}
+	if req.Url != "" {
+		if err := r.ValidateUrl(req.Url); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// queryEscapeActions pipes the output of every action under node through
+// urlquery so variables can not add parameters or change the url.
+func queryEscapeActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			queryEscapeActions(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pos,
+				Args:     []parse.Node{parse.NewIdentifier("urlquery").SetTree(nil).SetPos(n.Pos)},
+			})
+		}
+	case *parse.IfNode:
+		queryEscapeActions(n.List)
+		queryEscapeActions(n.ElseList)
+	case *parse.RangeNode:
+		queryEscapeActions(n.List)
+		queryEscapeActions(n.ElseList)
+	case *parse.WithNode:
+		queryEscapeActions(n.List)
+		queryEscapeActions(n.ElseList)
+	}
+}
+
+func checkTemplateVars(types map[string]TemplateVarType, vars map[string]interface{}) error {
+	for name := range vars {
+		if _, ok := types[name]; !ok {
+			return ErrorTemplate("未声明的变量 " + name)
+		}
+	}
+	for name, varType := range types {
+		value, ok := vars[name]
+		if !ok {
+			return ErrorTemplate("缺少变量 " + name)
+		}
+		var valid bool
+		switch varType {
+		case TemplateVarString:
+			_, valid = value.(string)
+		case TemplateVarInt:
+			switch value.(type) {
+			case int, int32, int64:
+				valid = true
+			}
+		case TemplateVarAmount:
+			_, valid = value.(Fen)
+		case TemplateVarTime:
+			switch value.(type) {
+			case time.Time, localTime.Time:
+				valid = true
+			}
+		}
+		if !valid {
+			return ErrorTemplate(fmt.Sprintf("变量 %s 应为 %s", name, varType))
+		}
+	}
+	return nil
+}
+
+// ValidateMessageContent checks content against the PushMessage length and
+// character rules, control characters and characters outside the basic
+// multilingual plane such as emoji are rejected.
+func ValidateMessageContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return ErrorTemplate("内容为空")
+	}
+	if utf8.RuneCountInString(content) > MessageContentMaxLength {
+		return ErrorTemplate(fmt.Sprintf("内容超过%d字", MessageContentMaxLength))
+	}
+	for _, c := range content {
+		if c == utf8.RuneError || unicode.IsControl(c) || c > 0xFFFF {
+			return ErrorTemplate(fmt.Sprintf("内容包含不支持的字符 %q", c))
+		}
+	}
+	return nil
+}
+
+// ValidateUrl accepts https urls whose host is in AllowedHosts, an entry
+// starting with "." also allows its subdomains.
+func (r *MessageTemplateRegistry) ValidateUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return ErrorTemplate("链接无效 " + rawUrl)
+	}
+	if !matchHost(u.Hostname(), r.AllowedHosts) {
+		return ErrorTemplate("链接域名不在白名单 " + u.Hostname())
+	}
+	return nil
+}
+
+// matchHost reports whether host is in list, an entry starting with "."
+// also matches its subdomains.
+func matchHost(host string, list []string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range list {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && (strings.HasSuffix(host, allowed) || host == allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+type localeContextKey struct{}
+
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeContextKey{}, locale)
+}
+
+func LocaleFromContext(ctx context.Context) string {
+	locale, _ := ctx.Value(localeContextKey{}).(string)
+	return locale
+}
+
+// SendTemplate renders a template of Config.MessageTemplates in the locale
+// of ctx and pushes it to openId.
+func (upa *UnionPayApp) SendTemplate(ctx context.Context, openId string, name string, vars map[string]interface{}) (*PushMessageResult, error) {
+	if upa.MessageTemplates == nil {
+		return nil, ErrorTemplate("MessageTemplates 未设置")
+	}
+	req, err := upa.MessageTemplates.Render(name, LocaleFromContext(ctx), vars)
+	if err != nil {
+		return nil, err
+	}
+	req.OpenId = openId
+	return upa.PushMessage(req)
+}
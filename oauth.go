@@ -1,10 +1,9 @@
 package unionPayApp
 
 import (
-	"encoding/base64"
-	"github.com/forgoer/openssl"
-	"github.com/go-tron/crypto/desUtil"
+	"context"
 	"github.com/google/go-querystring/query"
+	"net/url"
 )
 
 type Scope string
@@ -12,12 +11,49 @@ type Scope string
 const (
 	ScopeBase   Scope = "upapi_base"
 	ScopeMobile Scope = "upapi_mobile"
+	ScopeAuth   Scope = "upapi_auth"
 )
 
+type OAuthEntry string
+
+const (
+	OAuthEntryH5   OAuthEntry = "h5"
+	OAuthEntryApp  OAuthEntry = "app"
+	OAuthEntryMini OAuthEntry = "mini"
+)
+
+// OAuthEntryConfig is how an entry asks for the code. Url is the page
+// GetOAuthCode sends the user to, an entry without Url can only authorise
+// with upsdk through GetJsOAuthParams. Params are the url tags of
+// OAuthCodeQuery the entry takes.
+type OAuthEntryConfig struct {
+	Url    string   `json:"url"`
+	Params []string `json:"params"`
+}
+
+// OAuthEntries holds the entry of each context. H5 pages redirect to the
+// authorisation page, App opens the same page in the UnionPay app through
+// its upwallet scheme from another app, and mini programs, which can not be
+// redirected back to, call upsdk.appletAuth.
+var OAuthEntries = map[OAuthEntry]*OAuthEntryConfig{
+	OAuthEntryH5: {
+		Url:    "https://open.95516.com/s/open/html/oauth.html",
+		Params: []string{"appId", "redirectUri", "responseType", "scope", "state"},
+	},
+	OAuthEntryApp: {
+		Url:    "upwallet://html/open.95516.com/s/open/html/oauth.html",
+		Params: []string{"appId", "redirectUri", "responseType", "scope", "state"},
+	},
+	OAuthEntryMini: {
+		Params: []string{"appId", "scope", "state"},
+	},
+}
+
 type OAuthCodeReq struct {
-	Uri   string `json:"uri"`
-	Scope Scope  `json:"scope"`
-	State string `json:"state"`
+	Uri   string     `json:"uri"`
+	Scope Scope      `json:"scope"`
+	State string     `json:"state"`
+	Entry OAuthEntry `json:"entry"`
 }
 
 type OAuthCodeQuery struct {
@@ -29,6 +65,15 @@ type OAuthCodeQuery struct {
 }
 
 func (upa *UnionPayApp) GetOAuthCode(params *OAuthCodeReq) (string, error) {
+	entry := params.Entry
+	if entry == "" {
+		entry = OAuthEntryH5
+	}
+	config := OAuthEntries[entry]
+	if config == nil || config.Url == "" {
+		return "", ErrorParam("entry")
+	}
+
 	req := OAuthCodeQuery{
 		AppId:        upa.AppId,
 		RedirectUri:  params.Uri,
@@ -43,7 +88,13 @@ func (upa *UnionPayApp) GetOAuthCode(params *OAuthCodeReq) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return "https://open.95516.com/s/open/html/oauth.html?" + v.Encode(), nil
+	q := url.Values{}
+	for _, name := range config.Params {
+		if value, ok := v[name]; ok {
+			q[name] = value
+		}
+	}
+	return config.Url + "?" + q.Encode(), nil
 }
 
 type OAuthToken struct {
@@ -52,6 +103,7 @@ type OAuthToken struct {
 	RefreshToken string `json:"refreshToken"`
 	OpenId       string `json:"openId"`
 	Scope        string `json:"scope"`
+	ExpiresAt    int64  `json:"expiresAt,omitempty"`
 }
 
 func (upa *UnionPayApp) GetOAuthToken(code string) (*OAuthToken, error) {
@@ -63,6 +115,22 @@ func (upa *UnionPayApp) GetOAuthToken(code string) (*OAuthToken, error) {
 	if err != nil {
 		return nil, err
 	}
+	token := res.(*OAuthToken)
+	if err := upa.SaveUserToken(context.Background(), token); err != nil {
+		upa.Logger.Error("SaveUserToken", upa.Logger.Field("error", err), upa.Logger.Field("openId", token.OpenId))
+	}
+	return token, nil
+}
+
+func (upa *UnionPayApp) RefreshOAuthToken(refreshToken string) (*OAuthToken, error) {
+	res, err := upa.Request("OAuthRefresh", map[string]interface{}{
+		"appId":        upa.AppId,
+		"refreshToken": refreshToken,
+		"grantType":    "refresh_token",
+	}, &OAuthToken{})
+	if err != nil {
+		return nil, err
+	}
 	return res.(*OAuthToken), nil
 }
 
@@ -72,7 +140,7 @@ type OAuthMobileReq struct {
 }
 
 type OAuthMobile struct {
-	Mobile string `json:"mobile"`
+	Mobile string `json:"mobile" upa:"encrypt"`
 }
 
 func (upa *UnionPayApp) GetOAuthMobile(params *OAuthMobileReq) (*OAuthMobile, error) {
@@ -86,26 +154,68 @@ func (upa *UnionPayApp) GetOAuthMobile(params *OAuthMobileReq) (*OAuthMobile, er
 	}
 
 	result := res.(*OAuthMobile)
-	src, err := base64.StdEncoding.DecodeString(result.Mobile)
+	if err := upa.FieldCipher().DecryptStruct(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (upa *UnionPayApp) GetOAuthMobileFromCode(code string) (*OAuthMobile, error) {
+	res, err := upa.GetOAuthToken(code)
 	if err != nil {
 		return nil, err
 	}
+	return upa.GetOAuthMobile(&OAuthMobileReq{
+		OpenId:      res.OpenId,
+		AccessToken: res.AccessToken,
+	})
+}
 
-	mobile, err := desUtil.Des3ECBDecrypt(src, upa.encryptKeyByte, openssl.PKCS5_PADDING)
+type OAuthAuthReq struct {
+	OpenId      string `json:"openId"`
+	AccessToken string `json:"accessToken"`
+}
+
+type OAuthAuth struct {
+	Name     string `json:"name" upa:"encrypt"`
+	CertType string `json:"certifTp"`
+	CertId   string `json:"certifId" upa:"encrypt"`
+	CardNo   string `json:"cardNo" upa:"encrypt"`
+	CardType string `json:"cardType"`
+}
+
+func (upa *UnionPayApp) GetOAuthAuth(params *OAuthAuthReq) (*OAuthAuth, error) {
+	res, err := upa.Request("OAuthAuth", map[string]interface{}{
+		"appId":       upa.AppId,
+		"accessToken": params.AccessToken,
+		"openId":      params.OpenId,
+	}, &OAuthAuth{})
 	if err != nil {
 		return nil, err
 	}
-	result.Mobile = string(mobile)
+
+	result := res.(*OAuthAuth)
+	if err := upa.FieldCipher().DecryptStruct(result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-func (upa *UnionPayApp) GetOAuthMobileFromCode(code string) (*OAuthMobile, error) {
+func (upa *UnionPayApp) GetOAuthAuthFromCode(code string) (*OAuthAuth, error) {
 	res, err := upa.GetOAuthToken(code)
 	if err != nil {
 		return nil, err
 	}
-	return upa.GetOAuthMobile(&OAuthMobileReq{
+	return upa.GetOAuthAuth(&OAuthAuthReq{
 		OpenId:      res.OpenId,
 		AccessToken: res.AccessToken,
 	})
 }
+
+func (upa *UnionPayApp) GetOpenIdFromCode(code string) (string, error) {
+	res, err := upa.GetOAuthToken(code)
+	if err != nil {
+		return "", err
+	}
+	return res.OpenId, nil
+}
@@ -0,0 +1,176 @@
+package unionPayApp
+
+import (
+	"context"
+	baseError "github.com/go-tron/base-error"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const OAuthCodePrefix = "upa-oauth-code:"
+
+// OAuthCodeTTL is how long a used code is remembered, it only needs to
+// outlive the code itself.
+var OAuthCodeTTL = time.Minute * 10
+
+var (
+	ErrorCodeUsed = baseError.System("3111", "云闪付授权码已使用")
+)
+
+type OAuthResult struct {
+	Uri    string       `json:"uri"`
+	Code   string       `json:"code"`
+	State  *OAuthState  `json:"state"`
+	Token  *OAuthToken  `json:"token"`
+	Mobile *OAuthMobile `json:"mobile"`
+	Auth   *OAuthAuth   `json:"auth"`
+}
+
+// OAuthHandler handles the redirect sent to OAuthRedirectUri, SkipState
+// turns off state verification for states not issued by IssueState. When
+// Session is set the openId is bound to a session cookie before Success.
+// The user is sent back to the ReturnUrl of the verified state, or to the
+// uri parameter when it is a local path or its host is in AllowedHosts, an
+// entry starting with "." also allowing subdomains. Otherwise OAuthResult
+// has no Uri and the handler answers 204.
+type OAuthHandler struct {
+	App          *UnionPayApp
+	AllowedHosts []string
+	Session      *SessionBinder
+	SkipState    bool
+	FetchMobile  bool
+	FetchAuth    bool
+	Success      func(w http.ResponseWriter, r *http.Request, res *OAuthResult)
+	Failure      func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+func (h *OAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, err := h.handle(r.Context(), r.URL.Query())
+	if err != nil {
+		h.App.Logger.Error("OAuthHandler", h.App.Logger.Field("error", err), h.App.Logger.Field("appId", h.App.AppId))
+		if h.Failure != nil {
+			h.Failure(w, r, err)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	if h.Session != nil {
+		if err := h.Session.SetCookie(w, res.Token.OpenId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if h.Success != nil {
+		h.Success(w, r, res)
+		return
+	}
+	if res.Uri == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, res.Uri, http.StatusFound)
+}
+
+func (h *OAuthHandler) handle(ctx context.Context, query url.Values) (*OAuthResult, error) {
+	upa := h.App
+	res := &OAuthResult{
+		Uri:  h.allowedUri(oAuthCallbackUri(query)),
+		Code: query.Get("code"),
+	}
+	if res.Code == "" {
+		return nil, ErrorParam("code")
+	}
+
+	if !h.SkipState {
+		state, err := upa.VerifyState(ctx, query.Get("state"))
+		if err != nil {
+			return nil, err
+		}
+		res.State = state
+		if state.ReturnUrl != "" {
+			res.Uri = state.ReturnUrl
+		}
+	}
+
+	ok, err := upa.Redis.SetNX(ctx, OAuthCodePrefix+upa.AppId+":"+res.Code, 1, OAuthCodeTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrorCodeUsed
+	}
+
+	token, err := upa.GetOAuthToken(res.Code)
+	if err != nil {
+		return nil, err
+	}
+	res.Token = token
+
+	if h.FetchMobile && strings.Contains(token.Scope, string(ScopeMobile)) {
+		mobile, err := upa.GetOAuthMobile(&OAuthMobileReq{
+			OpenId:      token.OpenId,
+			AccessToken: token.AccessToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Mobile = mobile
+	}
+
+	if h.FetchAuth && strings.Contains(token.Scope, string(ScopeAuth)) {
+		auth, err := upa.GetOAuthAuth(&OAuthAuthReq{
+			OpenId:      token.OpenId,
+			AccessToken: token.AccessToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Auth = auth
+	}
+	return res, nil
+}
+
+// allowedUri returns uri when it may be redirected to, the uri parameter is
+// not signed and anyone can put a foreign site in it.
+func (h *OAuthHandler) allowedUri(uri string) string {
+	if uri == "" || strings.ContainsAny(uri, "\\\r\n") {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") {
+		return uri
+	}
+	if (u.Scheme == "https" || u.Scheme == "http") && u.User == nil && matchHost(u.Hostname(), h.AllowedHosts) {
+		return uri
+	}
+	return ""
+}
+
+// oAuthCallbackUri restores the uri appended to OAuthRedirectUri, query
+// parameters of the original uri end up beside code and state.
+func oAuthCallbackUri(query url.Values) string {
+	uri := query.Get("uri")
+	if uri == "" {
+		return ""
+	}
+	extra := url.Values{}
+	for k, v := range query {
+		if k == "uri" || k == "code" || k == "state" {
+			continue
+		}
+		extra[k] = v
+	}
+	if len(extra) == 0 {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + extra.Encode()
+	}
+	return uri + "?" + extra.Encode()
+}
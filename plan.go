@@ -0,0 +1,30 @@
+package unionPayApp
+
+import (
+	baseError "github.com/go-tron/base-error"
+)
+
+var (
+	ErrorPlan = baseError.SystemFactory("3119", "云闪付签约计划不存在:{}")
+)
+
+// GetPlanId looks up a plan registered in Config.Plans by its business alias.
+func (upa *UnionPayApp) GetPlanId(alias string) (string, error) {
+	planId, ok := upa.Plans[alias]
+	if !ok || planId == "" {
+		return "", ErrorPlan(alias)
+	}
+	return planId, nil
+}
+
+// planId resolves the plan of a contract request, it may be an alias from
+// Config.Plans or a plan id, and defaults to Config.PlanId.
+func (upa *UnionPayApp) planId(planId string) string {
+	if planId == "" {
+		return upa.PlanId
+	}
+	if id, ok := upa.Plans[planId]; ok && id != "" {
+		return id
+	}
+	return planId
+}
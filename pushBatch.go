@@ -0,0 +1,156 @@
+package unionPayApp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type PushResult struct {
+	OpenId   string             `json:"openId"`
+	Success  bool               `json:"success"`
+	MsgId    string             `json:"msgId,omitempty"`
+	RespCode string             `json:"respCode"`
+	Error    string             `json:"error,omitempty"`
+	Response *PushMessageResult `json:"response,omitempty"`
+}
+
+type PushBatchSummary struct {
+	Total     int            `json:"total"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	RespCodes map[string]int `json:"respCodes"`
+	Elapsed   time.Duration  `json:"elapsed"`
+}
+
+type PushBatchOptions struct {
+	Workers       int
+	RatePerSecond int
+	OnResult      func(result *PushResult)
+	OnProgress    func(summary *PushBatchSummary)
+}
+
+// PushRecipients turns a slice into the channel PushBatch reads from.
+func PushRecipients(ctx context.Context, reqs []*PushMessageReq) <-chan *PushMessageReq {
+	ch := make(chan *PushMessageReq)
+	go func() {
+		defer close(ch)
+		for _, req := range reqs {
+			select {
+			case ch <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// PushBatch pushes every message read from recipients with a fixed number
+// of workers. It stops reading when ctx is done and returns the summary of
+// the messages read so far, a message read but not pushed fails with the
+// error of ctx. OnProgress gets a copy of the summary.
+func (upa *UnionPayApp) PushBatch(ctx context.Context, recipients <-chan *PushMessageReq, opts *PushBatchOptions) (*PushBatchSummary, error) {
+	if opts == nil {
+		opts = &PushBatchOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 8
+	}
+
+	var limiter <-chan time.Time
+	if opts.RatePerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.RatePerSecond))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		start   = time.Now()
+		summary = &PushBatchSummary{RespCodes: make(map[string]int)}
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var req *PushMessageReq
+				select {
+				case <-ctx.Done():
+					return
+				case r, ok := <-recipients:
+					if !ok {
+						return
+					}
+					req = r
+				}
+				if limiter != nil {
+					select {
+					case <-limiter:
+					case <-ctx.Done():
+					}
+				}
+				// select picks at random when ctx is done and a recipient is
+				// ready, so the recipient may have been taken after cancelling
+				var result *PushResult
+				cancelled := ctx.Err() != nil
+				if cancelled {
+					result = &PushResult{OpenId: req.OpenId, Error: ctx.Err().Error()}
+				} else {
+					result = upa.push(req)
+				}
+				if opts.OnResult != nil {
+					opts.OnResult(result)
+				}
+
+				lock.Lock()
+				summary.Total++
+				if result.Success {
+					summary.Succeeded++
+				} else {
+					summary.Failed++
+				}
+				summary.RespCodes[result.RespCode]++
+				summary.Elapsed = time.Since(start)
+				if opts.OnProgress != nil {
+					opts.OnProgress(summary.copy())
+				}
+				lock.Unlock()
+				if cancelled {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	summary.Elapsed = time.Since(start)
+	return summary, ctx.Err()
+}
+
+func (s *PushBatchSummary) copy() *PushBatchSummary {
+	c := *s
+	c.RespCodes = make(map[string]int, len(s.RespCodes))
+	for code, n := range s.RespCodes {
+		c.RespCodes[code] = n
+	}
+	return &c
+}
+
+func (upa *UnionPayApp) push(req *PushMessageReq) *PushResult {
+	result := &PushResult{OpenId: req.OpenId}
+	res, err := upa.PushMessage(req)
+	if err != nil {
+		result.RespCode = RespCode(err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	result.RespCode = "00"
+	result.MsgId = res.MsgId
+	result.Response = res
+	return result
+}
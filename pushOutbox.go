@@ -0,0 +1,228 @@
+package unionPayApp
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	OutboxFailed  OutboxStatus = "failed"
+)
+
+// OutboxMessage is a push written in the same transaction as the business
+// change it announces. DedupKey identifies the message for the business, a
+// second message with the same DedupKey is not enqueued.
+type OutboxMessage struct {
+	Id            string       `json:"id"`
+	DedupKey      string       `json:"dedupKey"`
+	OpenId        string       `json:"openId"`
+	Content       string       `json:"content"`
+	Url           string       `json:"url"`
+	Status        OutboxStatus `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"lastError,omitempty"`
+	CreatedAt     int64        `json:"createdAt"`
+	NextAttemptAt int64        `json:"nextAttemptAt"`
+	SentAt        int64        `json:"sentAt,omitempty"`
+	MsgId         string       `json:"msgId,omitempty"`
+}
+
+func NewOutboxMessage(dedupKey string, req *PushMessageReq) (*OutboxMessage, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	if dedupKey == "" {
+		dedupKey = id
+	}
+	now := time.Now().Unix()
+	return &OutboxMessage{
+		Id:            id,
+		DedupKey:      dedupKey,
+		OpenId:        req.OpenId,
+		Content:       req.Content,
+		Url:           req.Url,
+		Status:        OutboxPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}, nil
+}
+
+// OutboxStore keeps the outbox next to the business data. Enqueue writes
+// with tx, the transaction of the caller such as a *sql.Tx, and ignores a
+// message whose DedupKey exists. Claim takes pending messages whose
+// NextAttemptAt has passed, oldest first, and moves their NextAttemptAt to
+// leaseUntil in the same atomic step, e.g. one UPDATE ... RETURNING, so
+// relays sharing the store never claim the same message while its lease
+// runs. A message a relay claimed but never updated is claimed again once
+// the lease is over.
+type OutboxStore interface {
+	Enqueue(ctx context.Context, tx interface{}, msg *OutboxMessage) error
+	Claim(ctx context.Context, now time.Time, limit int, leaseUntil time.Time) ([]*OutboxMessage, error)
+	Update(ctx context.Context, msg *OutboxMessage) error
+	Get(ctx context.Context, id string) (*OutboxMessage, error)
+}
+
+type MemoryOutboxStore struct {
+	lock     sync.Mutex
+	messages map[string]OutboxMessage
+	dedup    map[string]string
+}
+
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{
+		messages: make(map[string]OutboxMessage),
+		dedup:    make(map[string]string),
+	}
+}
+
+func (s *MemoryOutboxStore) Enqueue(ctx context.Context, tx interface{}, msg *OutboxMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.dedup[msg.DedupKey]; ok {
+		return nil
+	}
+	s.dedup[msg.DedupKey] = msg.Id
+	s.messages[msg.Id] = *msg
+	return nil
+}
+
+func (s *MemoryOutboxStore) Claim(ctx context.Context, now time.Time, limit int, leaseUntil time.Time) ([]*OutboxMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []*OutboxMessage
+	for _, msg := range s.messages {
+		if msg.Status == OutboxPending && msg.NextAttemptAt <= now.Unix() {
+			msg := msg
+			res = append(res, &msg)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAt != res[j].CreatedAt {
+			return res[i].CreatedAt < res[j].CreatedAt
+		}
+		return res[i].Id < res[j].Id
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	for _, msg := range res {
+		msg.NextAttemptAt = leaseUntil.Unix()
+		s.messages[msg.Id] = *msg
+	}
+	return res, nil
+}
+
+func (s *MemoryOutboxStore) Update(ctx context.Context, msg *OutboxMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages[msg.Id] = *msg
+	return nil
+}
+
+func (s *MemoryOutboxStore) Get(ctx context.Context, id string) (*OutboxMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, nil
+	}
+	return &msg, nil
+}
+
+// OutboxRelay drains an OutboxStore through PushMessage. A message is marked
+// sent only after PushMessage succeeded, so a crash in between pushes it
+// again: delivery is at least once. Lease should outlast pushing a batch,
+// otherwise another relay may claim messages still being pushed.
+type OutboxRelay struct {
+	App         *UnionPayApp
+	Store       OutboxStore
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+	Interval    time.Duration
+	BatchSize   int
+	Lease       time.Duration
+}
+
+func (upa *UnionPayApp) OutboxRelay(store OutboxStore) *OutboxRelay {
+	return &OutboxRelay{App: upa, Store: store}
+}
+
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Drain(ctx); err != nil {
+			r.App.Logger.Error("OutboxRelay", r.App.Logger.Field("error", err), r.App.Logger.Field("appId", r.App.AppId))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain pushes the pending messages due now and returns how many were sent.
+func (r *OutboxRelay) Drain(ctx context.Context) (int, error) {
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	lease := r.Lease
+	if lease <= 0 {
+		lease = time.Minute * 5
+	}
+
+	now := time.Now()
+	messages, err := r.Store.Claim(ctx, now, batchSize, now.Add(lease))
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		res, pushErr := r.App.PushMessage(&PushMessageReq{
+			OpenId:  msg.OpenId,
+			Content: msg.Content,
+			Url:     msg.Url,
+		})
+		msg.Attempts++
+		now := time.Now()
+		if pushErr == nil {
+			msg.Status = OutboxSent
+			msg.LastError = ""
+			msg.SentAt = now.Unix()
+			msg.MsgId = res.MsgId
+			sent++
+		} else {
+			msg.LastError = pushErr.Error()
+			if msg.Attempts >= maxAttempts {
+				msg.Status = OutboxFailed
+			} else {
+				msg.NextAttemptAt = now.Add(retryBackoff(r.Backoff, msg.Attempts)).Unix()
+			}
+		}
+		if err := r.Store.Update(ctx, msg); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
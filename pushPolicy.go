@@ -0,0 +1,246 @@
+package unionPayApp
+
+import (
+	"context"
+	"github.com/go-tron/local-time"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PushDailyPrefix    = "upa-push-daily:"
+	PushCooldownPrefix = "upa-push-cooldown:"
+)
+
+type PushBlockReason string
+
+const (
+	PushBlockUnauthorized PushBlockReason = "unauthorized"
+	PushBlockQuietHours   PushBlockReason = "quiet_hours"
+	PushBlockDailyCap     PushBlockReason = "daily_cap"
+	PushBlockCooldown     PushBlockReason = "cooldown"
+)
+
+type PushAction string
+
+const (
+	PushDrop  PushAction = "drop"
+	PushDefer PushAction = "defer"
+)
+
+// PushDecision tells what PushPolicy did with a message. A blocked message
+// has a Reason and is either dropped or scheduled on the queue as DeferId.
+type PushDecision struct {
+	Sent       bool               `json:"sent"`
+	Reason     PushBlockReason    `json:"reason,omitempty"`
+	Action     PushAction         `json:"action,omitempty"`
+	DeferId    string             `json:"deferId,omitempty"`
+	DeferUntil int64              `json:"deferUntil,omitempty"`
+	Result     *PushMessageResult `json:"result,omitempty"`
+}
+
+// PushPolicy checks a message before PushMessage. Quiet hours run from
+// QuietFrom to QuietTo after midnight in Asia/Shanghai, equal values turn
+// them off. DailyCap counts the messages of an openId per Shanghai day,
+// Cooldowns is the minimum interval between two pushes of a template to an
+// openId, a message that is blocked or fails is not counted. Actions
+// chooses per reason whether a blocked message is dropped or deferred on
+// Queue, a reason without an action is dropped and so is every deferral
+// when Queue is nil. Deferred messages are pushed by the queue without
+// checking the policy again and count on the day they are pushed. With
+// RequireAuthorized, messages to users Authorized rejects are blocked. When
+// Authorized is nil only users with a token in the user token vault pass,
+// a local guess that blocks users authorised elsewhere or long ago.
+type PushPolicy struct {
+	App               *UnionPayApp
+	Queue             *PushQueue
+	DailyCap          int
+	QuietFrom         time.Duration
+	QuietTo           time.Duration
+	Cooldowns         map[string]time.Duration
+	RequireAuthorized bool
+	Authorized        func(ctx context.Context, openId string) (bool, error)
+	Actions           map[PushBlockReason]PushAction
+}
+
+func (p *PushPolicy) Push(ctx context.Context, req *PushMessageReq) (*PushDecision, error) {
+	return p.push(ctx, "", req)
+}
+
+// PushTemplate renders a template of Config.MessageTemplates like
+// SendTemplate and pushes it under the cooldown of the template.
+func (p *PushPolicy) PushTemplate(ctx context.Context, openId string, name string, vars map[string]interface{}) (*PushDecision, error) {
+	if p.App.MessageTemplates == nil {
+		return nil, ErrorTemplate("MessageTemplates 未设置")
+	}
+	req, err := p.App.MessageTemplates.Render(name, LocaleFromContext(ctx), vars)
+	if err != nil {
+		return nil, err
+	}
+	req.OpenId = openId
+	return p.push(ctx, name, req)
+}
+
+var (
+	pushLocationOnce sync.Once
+	pushLocation     *time.Location
+	pushLocationErr  error
+)
+
+// loadPushLocation loads the zone of quiet hours and daily caps once.
+func loadPushLocation() (*time.Location, error) {
+	pushLocationOnce.Do(func() {
+		pushLocation, pushLocationErr = time.LoadLocation(localTime.Zone)
+	})
+	return pushLocation, pushLocationErr
+}
+
+func pushDailyKey(appId string, openId string, t time.Time) string {
+	return PushDailyPrefix + appId + ":" + openId + ":" + t.Format("20060102")
+}
+
+// countDailyPush counts a message pushed to openId on the Shanghai day of t.
+func countDailyPush(ctx context.Context, upa *UnionPayApp, openId string, t time.Time) (int, error) {
+	loc, err := loadPushLocation()
+	if err != nil {
+		return 0, err
+	}
+	return upa.Redis.IncrExpire(ctx, pushDailyKey(upa.AppId, openId, t.In(loc)), time.Hour*48)
+}
+
+func (p *PushPolicy) push(ctx context.Context, name string, req *PushMessageReq) (*PushDecision, error) {
+	loc, err := loadPushLocation()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(loc)
+
+	if p.RequireAuthorized {
+		authorized, err := p.authorized(ctx, req.OpenId)
+		if err != nil {
+			return nil, err
+		}
+		if !authorized {
+			return p.block(ctx, req, PushBlockUnauthorized, time.Time{})
+		}
+	}
+
+	if until, ok := p.quietUntil(now); ok {
+		return p.block(ctx, req, PushBlockQuietHours, until)
+	}
+
+	// undo takes back the count and the cooldown of a message not sent
+	var dailyKey, cooldownKey string
+	undo := func() {
+		if dailyKey != "" {
+			p.App.Redis.Decr(ctx, dailyKey)
+		}
+		if cooldownKey != "" {
+			p.App.Redis.Del(ctx, cooldownKey)
+		}
+	}
+
+	if p.DailyCap > 0 {
+		count, err := countDailyPush(ctx, p.App, req.OpenId, now)
+		if err != nil {
+			return nil, err
+		}
+		dailyKey = pushDailyKey(p.App.AppId, req.OpenId, now)
+		if count > p.DailyCap {
+			undo()
+			until := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+			if quietEnd, ok := p.quietUntil(until); ok {
+				until = quietEnd
+			}
+			return p.block(ctx, req, PushBlockDailyCap, until)
+		}
+	}
+
+	if cooldown := p.Cooldowns[name]; name != "" && cooldown > 0 {
+		key := PushCooldownPrefix + p.App.AppId + ":" + req.OpenId + ":" + name
+		ok, err := p.App.Redis.SetNX(ctx, key, 1, cooldown).Result()
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		if !ok {
+			undo()
+			ttl, err := p.App.Redis.PTTL(ctx, key).Result()
+			if err != nil {
+				return nil, err
+			}
+			if ttl < 0 {
+				ttl = cooldown
+			}
+			until := now.Add(ttl)
+			if quietEnd, ok := p.quietUntil(until); ok {
+				until = quietEnd
+			}
+			return p.block(ctx, req, PushBlockCooldown, until)
+		}
+		cooldownKey = key
+	}
+
+	res, err := p.App.PushMessage(req)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	return &PushDecision{Sent: true, Result: res}, nil
+}
+
+// authorized uses Authorized when set. Otherwise it only looks for a token
+// in the user token vault, which misses users who authorised through
+// another service or whose token is older than UserTokenTTL.
+func (p *PushPolicy) authorized(ctx context.Context, openId string) (bool, error) {
+	if p.Authorized != nil {
+		return p.Authorized(ctx, openId)
+	}
+	token, err := p.App.GetUserToken(ctx, openId)
+	if err != nil {
+		return false, err
+	}
+	return token != nil, nil
+}
+
+// quietUntil reports whether t is in quiet hours and when they end.
+func (p *PushPolicy) quietUntil(t time.Time) (time.Time, bool) {
+	if p.QuietFrom == p.QuietTo {
+		return time.Time{}, false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if p.QuietFrom < p.QuietTo {
+		if offset >= p.QuietFrom && offset < p.QuietTo {
+			return midnight.Add(p.QuietTo), true
+		}
+		return time.Time{}, false
+	}
+	if offset >= p.QuietFrom {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(p.QuietTo), true
+	}
+	if offset < p.QuietTo {
+		return midnight.Add(p.QuietTo), true
+	}
+	return time.Time{}, false
+}
+
+func (p *PushPolicy) block(ctx context.Context, req *PushMessageReq, reason PushBlockReason, until time.Time) (*PushDecision, error) {
+	decision := &PushDecision{Reason: reason, Action: PushDrop}
+	if p.Actions[reason] == PushDefer && p.Queue != nil && !until.IsZero() {
+		id, err := p.Queue.schedule(ctx, until, req, p.DailyCap > 0)
+		if err != nil {
+			return nil, err
+		}
+		decision.Action = PushDefer
+		decision.DeferId = id
+		decision.DeferUntil = until.Unix()
+	}
+	p.App.Logger.Info("PushPolicy",
+		p.App.Logger.Field("openId", req.OpenId),
+		p.App.Logger.Field("reason", string(reason)),
+		p.App.Logger.Field("action", string(decision.Action)),
+		p.App.Logger.Field("deferUntil", strconv.FormatInt(decision.DeferUntil, 10)))
+	return decision, nil
+}
@@ -0,0 +1,277 @@
+package unionPayApp
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-tron/redis"
+	"strconv"
+	"time"
+)
+
+const (
+	PushQueuePrefix           = "upa-push-queue:"
+	PushQueueMessagePrefix    = "upa-push-queue-msg:"
+	PushQueueProcessingPrefix = "upa-push-queue-processing:"
+	PushQueueDeadPrefix       = "upa-push-queue-dead:"
+)
+
+// pushQueueClaim moves due messages to the processing set in one step so
+// only one worker across pods gets each of them.
+var pushQueueClaim = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('ZADD', KEYS[2], ARGV[3], id)
+end
+return ids
+`)
+
+// pushQueueSchedule keeps the message and adds it to the due set.
+var pushQueueSchedule = redis.NewScript(`
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// pushQueueCancel removes a message not yet claimed by a worker.
+var pushQueueCancel = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// pushQueueAck finishes a claimed message. The message goes back to the due
+// set on retry, moves to the dead letter list on dead and is deleted
+// otherwise.
+var pushQueueAck = redis.NewScript(`
+redis.call('ZREM', KEYS[2], ARGV[1])
+if ARGV[2] == 'retry' then
+	redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+	redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+	return 1
+end
+redis.call('HDEL', KEYS[3], ARGV[1])
+if ARGV[2] == 'dead' then
+	redis.call('LPUSH', KEYS[4], ARGV[3])
+end
+return 1
+`)
+
+// pushQueueRestore puts messages whose lease ran out back to the due set.
+var pushQueueRestore = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[2], id)
+	redis.call('ZADD', KEYS[1], ARGV[1], id)
+end
+return #ids
+`)
+
+type QueuedPush struct {
+	Id        string `json:"id"`
+	OpenId    string `json:"openId"`
+	Content   string `json:"content"`
+	Url       string `json:"url"`
+	At        int64  `json:"at"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+	Daily     bool   `json:"daily,omitempty"`
+}
+
+// PushQueue schedules PushMessage calls in a Redis sorted set. Run claims
+// due messages, retries failures with Backoff and moves messages failing
+// MaxAttempts times to the dead letter list.
+type PushQueue struct {
+	App         *UnionPayApp
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+	Interval    time.Duration
+	BatchSize   int
+	Lease       time.Duration
+}
+
+func (upa *UnionPayApp) PushQueue() *PushQueue {
+	return &PushQueue{App: upa}
+}
+
+func (q *PushQueue) keys() []string {
+	return []string{
+		PushQueuePrefix + q.App.AppId,
+		PushQueueProcessingPrefix + q.App.AppId,
+		PushQueueMessagePrefix + q.App.AppId,
+		PushQueueDeadPrefix + q.App.AppId,
+	}
+}
+
+func (q *PushQueue) Schedule(ctx context.Context, at time.Time, msg *PushMessageReq) (string, error) {
+	return q.schedule(ctx, at, msg, false)
+}
+
+// schedule queues msg, with daily it counts toward the PushPolicy daily cap
+// once pushed.
+func (q *PushQueue) schedule(ctx context.Context, at time.Time, msg *PushMessageReq, daily bool) (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&QueuedPush{
+		Id:      id,
+		OpenId:  msg.OpenId,
+		Content: msg.Content,
+		Url:     msg.Url,
+		At:      at.Unix(),
+		Daily:   daily,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := pushQueueSchedule.Run(ctx, q.App.Redis, q.keys(), id, string(data), at.UnixMilli()).Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Cancel removes a scheduled message, it reports false when the message is
+// being pushed, was already sent or does not exist.
+func (q *PushQueue) Cancel(ctx context.Context, id string) (bool, error) {
+	removed, err := pushQueueCancel.Run(ctx, q.App.Redis, q.keys(), id).Int()
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+func (q *PushQueue) DeadLetters(ctx context.Context, limit int64) ([]*QueuedPush, error) {
+	list, err := q.App.Redis.LRange(ctx, q.keys()[3], 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var res []*QueuedPush
+	for _, data := range list {
+		var msg = &QueuedPush{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (q *PushQueue) Run(ctx context.Context) error {
+	interval := q.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := q.Poll(ctx); err != nil {
+			q.App.Logger.Error("PushQueue", q.App.Logger.Field("error", err), q.App.Logger.Field("appId", q.App.AppId))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll pushes up to BatchSize messages due now. Each message is claimed on
+// its own under Lease, which only has to outlast one PushMessage, so a slow
+// batch does not let another pod claim the messages still waiting.
+func (q *PushQueue) Poll(ctx context.Context) error {
+	batchSize := q.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	lease := q.Lease
+	if lease <= 0 {
+		lease = time.Minute
+	}
+
+	if err := pushQueueRestore.Run(ctx, q.App.Redis, q.keys(), time.Now().UnixMilli()).Err(); err != nil {
+		return err
+	}
+	for i := 0; i < batchSize; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		now := time.Now()
+		ids, err := pushQueueClaim.Run(ctx, q.App.Redis, q.keys(), now.UnixMilli(), 1, now.Add(lease).UnixMilli()).StringSlice()
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := q.process(ctx, ids[0]); err != nil {
+			q.App.Logger.Error("PushQueue", q.App.Logger.Field("error", err), q.App.Logger.Field("id", ids[0]))
+		}
+	}
+	return nil
+}
+
+func (q *PushQueue) process(ctx context.Context, id string) error {
+	data, err := q.App.Redis.HGet(ctx, q.keys()[2], id).Result()
+	if err == redis.Nil {
+		return pushQueueAck.Run(ctx, q.App.Redis, q.keys(), id, "done").Err()
+	}
+	if err != nil {
+		return err
+	}
+	var msg = &QueuedPush{}
+	if err := json.Unmarshal([]byte(data), msg); err != nil {
+		return err
+	}
+
+	_, pushErr := q.App.PushMessage(&PushMessageReq{
+		OpenId:  msg.OpenId,
+		Content: msg.Content,
+		Url:     msg.Url,
+	})
+	if pushErr == nil {
+		if msg.Daily {
+			if _, err := countDailyPush(ctx, q.App, msg.OpenId, time.Now()); err != nil {
+				q.App.Logger.Error("PushQueue", q.App.Logger.Field("error", err), q.App.Logger.Field("openId", msg.OpenId), q.App.Logger.Field("id", id))
+			}
+		}
+		return pushQueueAck.Run(ctx, q.App.Redis, q.keys(), id, "done").Err()
+	}
+
+	msg.Attempts++
+	msg.LastError = pushErr.Error()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	maxAttempts := q.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	if msg.Attempts >= maxAttempts {
+		err = pushQueueAck.Run(ctx, q.App.Redis, q.keys(), id, "dead", string(body)).Err()
+	} else {
+		err = pushQueueAck.Run(ctx, q.App.Redis, q.keys(), id, "retry", string(body), time.Now().Add(retryBackoff(q.Backoff, msg.Attempts)).UnixMilli()).Err()
+	}
+	q.App.Logger.Error("PushQueue",
+		q.App.Logger.Field("error", pushErr),
+		q.App.Logger.Field("openId", msg.OpenId),
+		q.App.Logger.Field("id", id),
+		q.App.Logger.Field("attempts", strconv.Itoa(msg.Attempts)))
+	return err
+}
+
+// retryBackoff is the delay before the next attempt, custom when set,
+// otherwise a minute doubling per attempt up to an hour.
+func retryBackoff(custom func(attempts int) time.Duration, attempts int) time.Duration {
+	if custom != nil {
+		return custom(attempts)
+	}
+	d := time.Minute << uint(attempts-1)
+	if d > time.Hour || d <= 0 {
+		d = time.Hour
+	}
+	return d
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	baseError "github.com/go-tron/base-error"
-	"github.com/go-tron/types/mapUtil"
 	"github.com/tidwall/gjson"
+	"strings"
 )
 
 var (
@@ -18,6 +18,19 @@ var (
 	ErrorCode          = baseError.SystemFactory("3110")
 )
 
+// RespCode returns the UnionPay resp code carried by an ErrorCode error.
+func RespCode(err error) string {
+	e, ok := err.(*baseError.Error)
+	if !ok || e.Code != "3110" || !strings.HasPrefix(e.Msg, "(") {
+		return ""
+	}
+	code, _, found := strings.Cut(e.Msg[1:], ")")
+	if !found {
+		return ""
+	}
+	return code
+}
+
 func (upa *UnionPayApp) Request(name string, data map[string]interface{}, res interface{}) (result interface{}, err error) {
 
 	request, _ := json.Marshal(data)
@@ -64,12 +77,18 @@ func (upa *UnionPayApp) Request(name string, data map[string]interface{}, res in
 		return nil, ErrorCode(fmt.Sprintf("(%s)%s", code, message))
 	}
 
-	bodyData := gjson.Get(response, "params").Value()
+	params := gjson.Get(response, "params")
 	if res == nil {
-		return bodyData, nil
+		return params.Value(), nil
 	}
 
-	if err := mapUtil.ToStruct(bodyData, res); err != nil {
+	// decode the raw params, going through Value would turn large numbers
+	// into float64 before the result sees them
+	raw := params.Raw
+	if raw == "" {
+		raw = "null"
+	}
+	if err := json.Unmarshal([]byte(raw), res); err != nil {
 		return nil, ErrorUnmarshalBody
 	}
 
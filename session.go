@@ -0,0 +1,181 @@
+package unionPayApp
+
+import (
+	"context"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const SessionCookieName = "upa_session"
+
+// SessionTTL is the default lifetime of a session issued by SessionBinder.
+var SessionTTL = time.Hour * 24 * 7
+
+var (
+	ErrorSessionInvalid = baseError.System("3112", "云闪付会话无效")
+	ErrorSessionExpired = baseError.System("3113", "云闪付会话已过期")
+)
+
+type openIdContextKey struct{}
+
+func WithOpenId(ctx context.Context, openId string) context.Context {
+	return context.WithValue(ctx, openIdContextKey{}, openId)
+}
+
+func OpenIdFromContext(ctx context.Context) string {
+	openId, _ := ctx.Value(openIdContextKey{}).(string)
+	return openId
+}
+
+type Session struct {
+	AppId     string `json:"a"`
+	OpenId    string `json:"o"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// SessionBinder binds the openId from a ScopeBase authorisation to a signed
+// cookie. Middleware falls back to GetOAuthCode when no session is present.
+type SessionBinder struct {
+	App          *UnionPayApp
+	CookieName   string
+	CookieDomain string
+	CookiePath   string
+	MaxAge       time.Duration
+}
+
+func (s *SessionBinder) cookieName() string {
+	if s.CookieName == "" {
+		return SessionCookieName
+	}
+	return s.CookieName
+}
+
+func (s *SessionBinder) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return SessionTTL
+	}
+	return s.MaxAge
+}
+
+func (s *SessionBinder) Issue(openId string) (string, error) {
+	if openId == "" {
+		return "", ErrorParam("openId")
+	}
+	return s.App.signToken(&Session{
+		AppId:     s.App.AppId,
+		OpenId:    openId,
+		ExpiresAt: localTime.Now().Add(s.maxAge()).Unix(),
+	})
+}
+
+func (s *SessionBinder) Parse(token string) (*Session, error) {
+	var res = &Session{}
+	if !s.App.parseToken(token, res) || res.AppId != s.App.AppId || res.OpenId == "" {
+		return nil, ErrorSessionInvalid
+	}
+	if res.ExpiresAt <= localTime.Now().Unix() {
+		return nil, ErrorSessionExpired
+	}
+	return res, nil
+}
+
+func (s *SessionBinder) SetCookie(w http.ResponseWriter, openId string) error {
+	token, err := s.Issue(openId)
+	if err != nil {
+		return err
+	}
+	path := s.CookiePath
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    token,
+		Path:     path,
+		Domain:   s.CookieDomain,
+		MaxAge:   int(s.maxAge() / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *SessionBinder) FromRequest(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(s.cookieName())
+	if err != nil {
+		return nil, ErrorSessionInvalid
+	}
+	return s.Parse(cookie.Value)
+}
+
+// Middleware sets the session openId into the request context. Without a
+// session it redirects to GetOAuthCode with ScopeBase, and the redirect back
+// carrying code and state is completed here before the page is reloaded.
+func (s *SessionBinder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session, err := s.FromRequest(r); err == nil {
+			next.ServeHTTP(w, r.WithContext(WithOpenId(r.Context(), session.OpenId)))
+			return
+		}
+
+		query := r.URL.Query()
+		if code := query.Get("code"); code != "" {
+			if err := s.bind(w, r, code, query.Get("state")); err != nil {
+				s.App.Logger.Error("SessionBinder", s.App.Logger.Field("error", err), s.App.Logger.Field("appId", s.App.AppId))
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			query.Del("code")
+			query.Del("state")
+			u := *r.URL
+			u.RawQuery = query.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+
+		state, err := s.App.IssueState(nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redirect, err := s.App.GetOAuthCode(&OAuthCodeReq{
+			Uri:   requestUrl(r),
+			Scope: ScopeBase,
+			State: state,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+}
+
+func (s *SessionBinder) bind(w http.ResponseWriter, r *http.Request, code string, state string) error {
+	if _, err := s.App.VerifyState(r.Context(), state); err != nil {
+		return err
+	}
+	openId, err := s.App.GetOpenIdFromCode(code)
+	if err != nil {
+		return err
+	}
+	return s.SetCookie(w, openId)
+}
+
+func requestUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	return u.String()
+}
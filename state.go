@@ -0,0 +1,115 @@
+package unionPayApp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"strings"
+	"time"
+)
+
+const OAuthStatePrefix = "upa-oauth-state:"
+
+// OAuthStateTTL is the default lifetime of an issued state.
+var OAuthStateTTL = time.Minute * 10
+
+var (
+	ErrorStateInvalid  = baseError.System("3107", "云闪付state无效")
+	ErrorStateExpired  = baseError.System("3108", "云闪付state已过期")
+	ErrorStateReplayed = baseError.System("3109", "云闪付state已使用")
+)
+
+type OAuthStateReq struct {
+	ReturnUrl string            `json:"returnUrl"`
+	Claims    map[string]string `json:"claims"`
+	ExpiresIn time.Duration     `json:"expiresIn"`
+}
+
+type OAuthState struct {
+	Nonce     string            `json:"n"`
+	AppId     string            `json:"a"`
+	ExpiresAt int64             `json:"e"`
+	ReturnUrl string            `json:"r,omitempty"`
+	Claims    map[string]string `json:"c,omitempty"`
+}
+
+func (upa *UnionPayApp) IssueState(params *OAuthStateReq) (string, error) {
+	if params == nil {
+		params = &OAuthStateReq{}
+	}
+	expiresIn := params.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = OAuthStateTTL
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return upa.signToken(&OAuthState{
+		Nonce:     nonce,
+		AppId:     upa.AppId,
+		ExpiresAt: localTime.Now().Add(expiresIn).Unix(),
+		ReturnUrl: params.ReturnUrl,
+		Claims:    params.Claims,
+	})
+}
+
+func (upa *UnionPayApp) VerifyState(ctx context.Context, state string) (*OAuthState, error) {
+	var res = &OAuthState{}
+	if !upa.parseToken(state, res) || res.AppId != upa.AppId || res.Nonce == "" {
+		return nil, ErrorStateInvalid
+	}
+	ttl := time.Until(time.Unix(res.ExpiresAt, 0))
+	if ttl <= 0 {
+		return nil, ErrorStateExpired
+	}
+	ok, err := upa.Redis.SetNX(ctx, OAuthStatePrefix+upa.AppId+":"+res.Nonce, 1, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrorStateReplayed
+	}
+	return res, nil
+}
+
+func (upa *UnionPayApp) signToken(payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + upa.tokenSignature(body), nil
+}
+
+func (upa *UnionPayApp) parseToken(token string, payload interface{}) bool {
+	body, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(upa.tokenSignature(body))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, payload) == nil
+}
+
+func (upa *UnionPayApp) tokenSignature(body string) string {
+	mac := hmac.New(sha256.New, []byte(upa.Secret))
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
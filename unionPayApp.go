@@ -23,7 +23,10 @@ func NewWithConfig(c *config.Config, client *redis.Redis) *UnionPayApp {
 		AppId:            c.GetString("unionPayApp.appId"),
 		Secret:           c.GetString("unionPayApp.secret"),
 		EncryptKey:       c.GetString("unionPayApp.encryptKey"),
+		PlanId:           c.GetString("unionPayApp.planId"),
+		Plans:            c.GetStringMapString("unionPayApp.plans"),
 		OAuthRedirectUri: c.GetString("unionPayApp.oAuthRedirectUri"),
+		JsApiDebug:       c.GetBool("unionPayApp.jsApiDebug"),
 		Redis:            client,
 		Logger:           logger.NewZapWithConfig(c, "unionPayApp", "info"),
 	})
@@ -90,17 +93,25 @@ type UnionPayApp struct {
 }
 
 type Config struct {
-	Username         string        `json:"username"`
-	Password         string        `json:"password"`
-	BaseUrl          string        `json:"baseUrl"`
-	AppId            string        `json:"appId"`
-	Secret           string        `json:"secret"`
-	EncryptKey       string        `json:"encryptKey"`
-	PlanId           string        `json:"planId"`
-	encryptKeyByte   []byte        `json:"encryptKeyByte"`
-	OAuthRedirectUri string        `json:"oAuthRedirectUri"`
-	Logger           logger.Logger `json:"logger"`
-	Redis            *redis.Redis  `json:"redis"`
+	Username         string                   `json:"username"`
+	Password         string                   `json:"password"`
+	BaseUrl          string                   `json:"baseUrl"`
+	AppId            string                   `json:"appId"`
+	Secret           string                   `json:"secret"`
+	EncryptKey       string                   `json:"encryptKey"`
+	PlanId           string                   `json:"planId"`
+	Plans            map[string]string        `json:"plans"`
+	encryptKeyByte   []byte                   `json:"encryptKeyByte"`
+	OAuthRedirectUri string                   `json:"oAuthRedirectUri"`
+	Logger           logger.Logger            `json:"logger"`
+	Redis            *redis.Redis             `json:"redis"`
+	ContractStore    ContractStore            `json:"-"`
+	MessageTemplates *MessageTemplateRegistry `json:"-"`
+	JsApiDebug       bool                     `json:"jsApiDebug"`
+}
+
+func (upa *UnionPayApp) FieldCipher() *base.FieldCipher {
+	return base.NewFieldCipher(upa.encryptKeyByte)
 }
 
 type BackendTokenRes struct {
@@ -1,9 +1,23 @@
 package unionPayApp
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/go-tron/logger"
 	"github.com/go-tron/redis"
+	"github.com/go-tron/types/mapUtil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var account = UnionPayApp{
@@ -36,6 +50,575 @@ func TestUnionPayApp_GetOAuthCode(t *testing.T) {
 	t.Log(info)
 }
 
+func TestUnionPayApp_GetOAuthCodeEntry(t *testing.T) {
+	info, err := account.GetOAuthCode(&OAuthCodeReq{
+		Uri:   "https://unionpay-notice.eioos.com",
+		Scope: ScopeBase,
+		Entry: OAuthEntryApp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(info, "upwallet://html/open.95516.com/s/open/html/oauth.html?") || !strings.Contains(info, "redirectUri") {
+		t.Fatal(info)
+	}
+	if _, err := account.GetOAuthCode(&OAuthCodeReq{Uri: "https://unionpay-notice.eioos.com", Scope: ScopeBase, Entry: OAuthEntryMini}); err == nil {
+		t.Fatal("mini entry redirected")
+	}
+	if _, err := account.GetOAuthCode(&OAuthCodeReq{Uri: "https://unionpay-notice.eioos.com", Scope: ScopeBase, Entry: "wechat"}); err == nil {
+		t.Fatal("unknown entry accepted")
+	}
+
+	params, err := account.GetJsOAuthParams(&OAuthCodeReq{Scope: ScopeBase, State: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.AppId != account.AppId || params.Scope != string(ScopeBase) || params.State != "s1" {
+		t.Fatal(params)
+	}
+	if _, err := account.GetJsOAuthParams(&OAuthCodeReq{Scope: ScopeBase, Entry: OAuthEntryH5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := account.GetJsOAuthParams(&OAuthCodeReq{Scope: ScopeBase, Entry: "wechat"}); err == nil {
+		t.Fatal("unknown entry accepted by GetJsOAuthParams")
+	}
+}
+
+func TestUnionPayApp_VerifyState(t *testing.T) {
+	state, err := account.IssueState(&OAuthStateReq{
+		ReturnUrl: "https://unionpay-notice.eioos.com",
+		Claims:    map[string]string{"channel": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	res, err := account.VerifyState(context.Background(), state)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	t.Log(res)
+
+	if _, err := account.VerifyState(context.Background(), state); err != ErrorStateReplayed {
+		t.Fatal("replayed state accepted", err)
+	}
+	if _, err := account.VerifyState(context.Background(), state+"x"); err != ErrorStateInvalid {
+		t.Fatal("tampered state accepted", err)
+	}
+}
+
+func TestOAuthCallbackUri(t *testing.T) {
+	query, _ := url.ParseQuery("uri=https://unionpay-notice.eioos.com/pay?id=1&from=app&code=abc&state=xyz")
+	uri := oAuthCallbackUri(query)
+	if uri != "https://unionpay-notice.eioos.com/pay?id=1&from=app" {
+		t.Fatal(uri)
+	}
+}
+
+func TestOAuthHandler_allowedUri(t *testing.T) {
+	handler := &OAuthHandler{App: &account, AllowedHosts: []string{".eioos.com"}}
+	query, _ := url.ParseQuery("uri=https://evil.example/x&code=abc")
+	if uri := handler.allowedUri(oAuthCallbackUri(query)); uri != "" {
+		t.Fatal("unlisted uri followed", uri)
+	}
+	for _, uri := range []string{"//evil.example/x", "/\\evil.example", "https://user@evil.example", "javascript:alert(1)", "https://eioos.com.evil.example"} {
+		if res := handler.allowedUri(uri); res != "" {
+			t.Fatal("unlisted uri followed", res)
+		}
+	}
+	for _, uri := range []string{"https://unionpay-notice.eioos.com/pay?id=1", "/pay?id=1"} {
+		if res := handler.allowedUri(uri); res != uri {
+			t.Fatal("listed uri refused", uri)
+		}
+	}
+}
+
+func TestUnionPayApp_GetValidAccessToken(t *testing.T) {
+	requireRedis(t)
+	ctx := context.Background()
+	var lock sync.Mutex
+	refreshed := 0
+	resp := `{"resp":"00","params":{"accessToken":"access2","expiresIn":7200,"refreshToken":"refresh2"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		refreshed++
+		w.Write([]byte(resp))
+	}))
+	defer server.Close()
+	defer func(refresh string) {
+		SDKConfig["OAuthRefresh"] = refresh
+	}(SDKConfig["OAuthRefresh"])
+	SDKConfig["OAuthRefresh"] = server.URL
+	refreshes := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return refreshed
+	}
+
+	appId, _ := randomHex(8)
+	app := &UnionPayApp{
+		Config:       &Config{AppId: "test-" + appId, Logger: account.Logger, Redis: account.Redis},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	openId := "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE"
+	defer app.DeleteUserToken(ctx, openId)
+	save := func(accessToken string, expiresAt int64) {
+		if err := app.SaveUserToken(ctx, &OAuthToken{OpenId: openId, AccessToken: accessToken, RefreshToken: "refresh1", ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("access1", time.Now().Add(time.Hour).Unix())
+	if token, err := app.GetValidAccessToken(ctx, openId); err != nil || token != "access1" || refreshes() != 0 {
+		t.Fatal("valid token", token, err, refreshes())
+	}
+
+	save("access1", time.Now().Add(-time.Second).Unix())
+	if token, err := app.GetValidAccessToken(ctx, openId); err != nil || token != "access2" || refreshes() != 1 {
+		t.Fatal("refresh", token, err, refreshes())
+	}
+	if token, _ := app.GetUserToken(ctx, openId); token.RefreshToken != "refresh2" || token.OpenId != openId {
+		t.Fatal("refreshed token not saved", token)
+	}
+
+	// a refresh holding the lock is waited for instead of refreshing again
+	save("access1", time.Now().Add(-time.Second).Unix())
+	lockKey := UserTokenLockPrefix + app.AppId + ":" + openId
+	if !app.Redis.LockWithSecret(ctx, lockKey, "other", 10) {
+		t.Fatal("lock")
+	}
+	time.AfterFunc(time.Millisecond*200, func() {
+		app.SaveUserToken(ctx, &OAuthToken{OpenId: openId, AccessToken: "access3", RefreshToken: "refresh1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		app.Redis.UnlockWithSecret(ctx, lockKey, "other")
+	})
+	if token, err := app.GetValidAccessToken(ctx, openId); err != nil || token != "access3" || refreshes() != 1 {
+		t.Fatal("locked refresh", token, err, refreshes())
+	}
+
+	// a refused refresh keeps an access token that has not expired yet
+	lock.Lock()
+	resp = `{"resp":"99","msg":"refreshToken无效"}`
+	lock.Unlock()
+	save("access1", time.Now().Add(time.Second*30).Unix())
+	if token, err := app.GetValidAccessToken(ctx, openId); err != nil || token != "access1" {
+		t.Fatal("refused refresh of a live token", token, err)
+	}
+	save("access1", time.Now().Add(-time.Second).Unix())
+	if _, err := app.GetValidAccessToken(ctx, openId); err != ErrorReauthorize {
+		t.Fatal("refused refresh of an expired token", err)
+	}
+	if token, _ := app.GetUserToken(ctx, openId); token == nil {
+		t.Fatal("token dropped for a code not in RefreshTokenInvalidCodes")
+	}
+
+	defer func(codes []string) {
+		RefreshTokenInvalidCodes = codes
+	}(RefreshTokenInvalidCodes)
+	RefreshTokenInvalidCodes = []string{"99"}
+	if _, err := app.GetValidAccessToken(ctx, openId); err != ErrorReauthorize {
+		t.Fatal(err)
+	}
+	if token, _ := app.GetUserToken(ctx, openId); token != nil {
+		t.Fatal("invalid refresh token kept", token)
+	}
+
+	// a refresh failing without a resp code is not a reason to authorise again
+	server.Close()
+	save("access1", time.Now().Add(-time.Second).Unix())
+	if _, err := app.GetValidAccessToken(ctx, openId); err == nil || err == ErrorReauthorize {
+		t.Fatal("unreachable platform", err)
+	}
+}
+
+func TestSessionBinder(t *testing.T) {
+	binder := &SessionBinder{App: &account}
+	token, err := binder.Issue("neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	session, err := binder.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	t.Log(session)
+
+	if _, err := binder.Parse(token[:len(token)-1]); err != ErrorSessionInvalid {
+		t.Fatal("tampered session accepted", err)
+	}
+}
+
+func TestUnionPayApp_VerifyNotify(t *testing.T) {
+	data := map[string]interface{}{
+		"appId":          account.AppId,
+		"openId":         "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
+		"contractId":     "6218400000084452092",
+		"contractStatus": ContractStatusRelieved,
+		"operateTime":    "20240326103000",
+		"secret":         account.Secret,
+	}
+	hashed := sha256.Sum256([]byte(mapUtil.ToSortString(data)))
+	delete(data, "secret")
+	data["signature"] = hex.EncodeToString(hashed[:])
+
+	if err := account.VerifyNotify(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	data["contractStatus"] = ContractStatusOpened
+	if err := account.VerifyNotify(data, nil); err != ErrorNotifySignature {
+		t.Fatal("tampered notify accepted", err)
+	}
+}
+
+func TestContractNotifyHandler_invalid(t *testing.T) {
+	handler := &ContractNotifyHandler{App: &account}
+	serve := func(data map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(data)
+		r := httptest.NewRequest(http.MethodPost, "/contract/notify", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	sign := func(data map[string]interface{}) map[string]interface{} {
+		data["secret"] = account.Secret
+		hashed := sha256.Sum256([]byte(mapUtil.ToSortString(data)))
+		delete(data, "secret")
+		data["signature"] = hex.EncodeToString(hashed[:])
+		return data
+	}
+
+	if w := serve(map[string]interface{}{"appId": account.AppId, "contractStatus": "1", "signature": "00"}); w.Code != http.StatusBadRequest {
+		t.Fatal("bad signature", w.Code, w.Body.String())
+	}
+	if w := serve(sign(map[string]interface{}{"appId": "other", "contractStatus": "1"})); w.Code != http.StatusBadRequest {
+		t.Fatal("other appId", w.Code, w.Body.String())
+	}
+	if err := handler.dispatch(context.Background(), &ContractNotify{ContractStatus: "2"}); err != nil {
+		t.Fatal("unknown status not acknowledged", err)
+	}
+}
+
+func TestContractRegistry(t *testing.T) {
+	registry := &ContractRegistry{App: &account, Store: NewMemoryContractStore()}
+	ctx := context.Background()
+	openId := "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE"
+
+	if _, err := registry.Transition(ctx, &ContractRecord{OpenId: openId, PlanId: account.PlanId, ContractStatus: ContractStatusRelieved}); err == nil {
+		t.Fatal("relieved a contract never opened")
+	}
+	record, err := registry.Transition(ctx, &ContractRecord{OpenId: openId, PlanId: account.PlanId, ContractId: "6218400000084452092", ContractStatus: ContractStatusOpened})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(record)
+
+	record, err = registry.sync(ctx, account.PlanId, openId, &ContractInfo{ContractId: "6218400000084452092", ContractStatus: ContractStatusRelieved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ContractStatus != ContractStatusRelieved {
+		t.Fatal(record)
+	}
+
+	if _, err := registry.sync(ctx, account.PlanId, openId, &ContractInfo{ContractId: "6218400000084452092", ContractStatus: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Transition(ctx, &ContractRecord{OpenId: openId, PlanId: account.PlanId, ContractStatus: ContractStatusOpened}); err != nil {
+		t.Fatal("record in unknown status stuck", err)
+	}
+}
+
+// racingContractStore saves change before the first CompareAndSave, like a
+// change of another pod saved between Get and CompareAndSave.
+type racingContractStore struct {
+	*MemoryContractStore
+	change *ContractRecord
+}
+
+func (s *racingContractStore) CompareAndSave(ctx context.Context, record *ContractRecord, version int64) (bool, error) {
+	if change := s.change; change != nil {
+		s.change = nil
+		if _, err := s.MemoryContractStore.CompareAndSave(ctx, change, change.Version-1); err != nil {
+			return false, err
+		}
+	}
+	return s.MemoryContractStore.CompareAndSave(ctx, record, version)
+}
+
+func TestContractRegistry_conflict(t *testing.T) {
+	store := &racingContractStore{MemoryContractStore: NewMemoryContractStore()}
+	registry := &ContractRegistry{App: &account, Store: store}
+	ctx := context.Background()
+	openId := "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE"
+
+	record, err := registry.Transition(ctx, &ContractRecord{OpenId: openId, PlanId: account.PlanId, ContractId: "6218400000084452092", ContractStatus: ContractStatusOpened})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != 1 {
+		t.Fatal(record)
+	}
+
+	// the contract is synced back to NotOpen while it is being relieved, the
+	// relieve is checked again and refused instead of overwriting the sync
+	store.change = &ContractRecord{AppId: account.AppId, OpenId: openId, PlanId: account.PlanId, ContractStatus: ContractStatusNotOpen, Version: 2}
+	if _, err := registry.Transition(ctx, &ContractRecord{OpenId: openId, PlanId: account.PlanId, ContractStatus: ContractStatusRelieved}); err == nil {
+		t.Fatal("transition checked against a stale record")
+	}
+	if record, _ := registry.Get(ctx, account.PlanId, openId); record.ContractStatus != ContractStatusNotOpen || record.Version != 2 {
+		t.Fatal(record)
+	}
+}
+
+func TestFen(t *testing.T) {
+	var res Deduction
+	if err := json.Unmarshal([]byte(`{"orderId":"202403260001","txnAmt":"1250"}`), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Amount != 1250 || res.Amount.Yuan() != "12.50" {
+		t.Fatal(res.Amount)
+	}
+	if err := json.Unmarshal([]byte(`{"txnAmt":99}`), &res); err != nil || res.Amount.Yuan() != "0.99" {
+		t.Fatal(res.Amount, err)
+	}
+}
+
+func TestUnionPayApp_PlanId(t *testing.T) {
+	upa := &UnionPayApp{Config: &Config{
+		PlanId: account.PlanId,
+		Plans:  map[string]string{"parking": "3c7b1a0e5d2f4c6b8a9e0d1f2a3b4c5d"},
+	}}
+	if upa.planId("") != account.PlanId {
+		t.Fatal("default plan not used")
+	}
+	if upa.planId("parking") != "3c7b1a0e5d2f4c6b8a9e0d1f2a3b4c5d" {
+		t.Fatal("alias not resolved")
+	}
+	if _, err := upa.GetPlanId("utilities"); err == nil {
+		t.Fatal("unknown alias resolved")
+	}
+}
+
+type missingAccounts struct{}
+
+func (missingAccounts) GetAccountById(appId string) (*UnionPayApp, error) {
+	return nil, ErrorParam("appId")
+}
+
+type memoryCheckpoint struct {
+	checkpoint *ReconcileCheckpoint
+}
+
+func (m *memoryCheckpoint) Load(ctx context.Context) (*ReconcileCheckpoint, error) {
+	return m.checkpoint, nil
+}
+
+func (m *memoryCheckpoint) Save(ctx context.Context, checkpoint *ReconcileCheckpoint) error {
+	data, _ := json.Marshal(checkpoint)
+	m.checkpoint = &ReconcileCheckpoint{}
+	return json.Unmarshal(data, m.checkpoint)
+}
+
+type appAccounts struct {
+	app *UnionPayApp
+}
+
+func (a appAccounts) GetAccountById(appId string) (*UnionPayApp, error) {
+	return a.app, nil
+}
+
+func TestAccounts_reconcileNotOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"resp":"00","params":{"contractId":"","contractStatus":""}}`))
+	}))
+	defer server.Close()
+	defer func(info string) {
+		SDKConfig["ContractInfo"] = info
+	}(SDKConfig["ContractInfo"])
+	SDKConfig["ContractInfo"] = server.URL
+
+	app := &UnionPayApp{
+		Config:       &Config{AppId: account.AppId, PlanId: account.PlanId, Logger: account.Logger, ContractStore: NewMemoryContractStore()},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	accounts := &Accounts{Accounts: appAccounts{app: app}}
+	entry := accounts.reconcile(&ReconcileItem{AppId: app.AppId, OpenId: "1", Expected: ContractStatusNotOpen})
+	if entry.Result != ReconcileMatched || entry.Actual != ContractStatusNotOpen {
+		t.Fatal(entry)
+	}
+	if record, _ := app.ContractStore.Get(context.Background(), app.AppId, app.PlanId, "1"); record != nil {
+		t.Fatal("registry changed by reconcile", record)
+	}
+}
+
+func TestAccounts_ReconcileContracts(t *testing.T) {
+	accounts := &Accounts{Accounts: missingAccounts{}}
+	checkpoint := &memoryCheckpoint{}
+	stream := func(n int) <-chan *ReconcileItem {
+		items := make(chan *ReconcileItem)
+		go func() {
+			defer close(items)
+			for i := 0; i < n; i++ {
+				items <- &ReconcileItem{AppId: "unknown", OpenId: fmt.Sprint(i), Expected: ContractStatusOpened}
+			}
+		}()
+		return items
+	}
+
+	report, err := accounts.ReconcileContracts(context.Background(), stream(10), &ReconcileOptions{
+		Concurrency:     3,
+		Checkpoint:      checkpoint,
+		CheckpointEvery: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 10 || len(report.Errors) != 10 || report.Errors[9].OpenId != "9" {
+		t.Fatal(report)
+	}
+
+	if !checkpoint.checkpoint.Completed {
+		t.Fatal("checkpoint not completed", checkpoint.checkpoint)
+	}
+
+	// a completed checkpoint is a finished run, the next one starts over
+	checked := 0
+	report, err = accounts.ReconcileContracts(context.Background(), stream(12), &ReconcileOptions{
+		Checkpoint: checkpoint,
+		Progress:   func(progress *ReconcileProgress) { checked++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 12 || report.Total != 12 || report.Errors[0].OpenId != "0" || report.Errors[11].OpenId != "11" {
+		t.Fatal(checked, report)
+	}
+
+	// an interrupted run resumes after its offset
+	checkpoint.checkpoint.Completed = false
+	checkpoint.checkpoint.Offset = 10
+	checkpoint.checkpoint.Report.Total = 10
+	checkpoint.checkpoint.Report.Errors = checkpoint.checkpoint.Report.Errors[:10]
+	checked = 0
+	report, err = accounts.ReconcileContracts(context.Background(), stream(12), &ReconcileOptions{
+		Checkpoint: checkpoint,
+		Progress:   func(progress *ReconcileProgress) { checked++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || report.Total != 12 || report.Errors[11].OpenId != "11" {
+		t.Fatal(checked, report)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 13 || rows[0][0] != "result" || rows[1][0] != ReconcileError || rows[1][2] != "0" || rows[12][2] != "11" {
+		t.Fatal(rows)
+	}
+}
+
+func TestContractInfo_UnmarshalJSON(t *testing.T) {
+	var info ContractInfo
+	err := json.Unmarshal([]byte(`{"contractId":"6218400000084452092","contractStatus":1,"signTime":"20240326103000","bizType":"parking"}`), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ContractStatus.IsActive() || info.SignTime != "20240326103000" || info.Extra["bizType"] != "parking" {
+		t.Fatal(info)
+	}
+
+	var status ContractStatus
+	if err := json.Unmarshal([]byte(`"2"`), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.IsKnown() || status.IsActive() || status.IsTerminated() {
+		t.Fatal(status)
+	}
+	t.Log(status)
+}
+
+func TestRespCode(t *testing.T) {
+	if code := RespCode(ErrorCode("(34)重复签约")); code != "34" {
+		t.Fatal(code)
+	}
+	if code := RespCode(ErrorRequest); code != "" {
+		t.Fatal(code)
+	}
+}
+
+func TestNewContractCode(t *testing.T) {
+	code, err := NewContractCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 32 {
+		t.Fatal(code)
+	}
+	t.Log(code)
+}
+
+func TestUnionPayApp_CompleteContractSession(t *testing.T) {
+	requireRedis(t)
+	ctx := context.Background()
+	var lock sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls[r.URL.Path]++
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/oauth.token":
+			w.Write([]byte(`{"resp":"00","params":{"accessToken":"access1","expiresIn":7200,"openId":"neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE"}}`))
+		case "/contract.apply":
+			w.Write([]byte(`{"resp":"00","params":{"contractId":"6218400000084452092","operateTime":"20240326120000"}}`))
+		default:
+			w.Write([]byte(`{"resp":"99","msg":"code已使用"}`))
+		}
+	}))
+	defer server.Close()
+	defer func(token string, apply string) {
+		SDKConfig["OAuthToken"], SDKConfig["ContractApply"] = token, apply
+	}(SDKConfig["OAuthToken"], SDKConfig["ContractApply"])
+	SDKConfig["OAuthToken"] = server.URL + "/oauth.token"
+	SDKConfig["ContractApply"] = server.URL + "/contract.apply"
+
+	appId, _ := randomHex(8)
+	app := &UnionPayApp{
+		Config:       &Config{AppId: "test-" + appId, PlanId: account.PlanId, Logger: account.Logger, Redis: account.Redis},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	session, err := app.CreateContractSession(ctx, &ContractSessionReq{Uri: "https://unionpay-notice.eioos.com/contract"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Redis.Del(ctx, ContractSessionPrefix+app.AppId+":"+session.ContractCode)
+
+	_, first, err := app.CompleteContractSession(ctx, "code1", session.ContractCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed, second, err := app.CompleteContractSession(ctx, "code1", session.ContractCode)
+	if err != nil {
+		t.Fatal("repeated redirect", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if second.ContractId != first.ContractId || completed.OpenId == "" || calls["/oauth.token"] != 1 || calls["/contract.apply"] != 1 {
+		t.Fatal(second, completed, calls)
+	}
+}
+
 func TestUnionPayApp_ContractInfo(t *testing.T) {
 	info, err := account.ContractInfo(&ContractInfoReq{
 		OpenId: "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
@@ -60,6 +643,54 @@ func TestUnionPayApp_ContractRelieve(t *testing.T) {
 	t.Log("res", res)
 }
 
+func TestMessageTemplateRegistry(t *testing.T) {
+	registry := NewMessageTemplateRegistry(".eioos.com")
+	err := registry.Register(&MessageTemplate{
+		Name:    "parking",
+		Content: "您的车辆{{.plate}}停车费{{.amount.Yuan}}元已扣款",
+		Url:     "https://unionpay-notice.eioos.com/parking?plate={{.plate}}",
+		Vars:    map[string]TemplateVarType{"plate": TemplateVarString, "amount": TemplateVarAmount},
+		Locales: map[string]*MessageTemplateLocale{
+			"en":    {Content: "Parking fee {{.amount.Yuan}} CNY charged for {{.plate}}"},
+			"zh-TW": {Url: "https://unionpay-notice.eioos.com/tw/parking?plate={{.plate}}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := registry.Render("parking", "en", map[string]interface{}{"plate": "沪A12345", "amount": Fen(1250)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Content != "Parking fee 12.50 CNY charged for 沪A12345" || req.Url != "https://unionpay-notice.eioos.com/parking?plate=%E6%B2%AAA12345" {
+		t.Fatal(req)
+	}
+	req, err = registry.Render("parking", "", map[string]interface{}{"plate": "A&redirect=https://evil.com#", "amount": Fen(1250)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Url != "https://unionpay-notice.eioos.com/parking?plate=A%26redirect%3Dhttps%3A%2F%2Fevil.com%23" {
+		t.Fatal(req.Url)
+	}
+	req, err = registry.Render("parking", "zh-TW", map[string]interface{}{"plate": "沪A12345", "amount": Fen(1250)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Content != "您的车辆沪A12345停车费12.50元已扣款" || req.Url != "https://unionpay-notice.eioos.com/tw/parking?plate=%E6%B2%AAA12345" {
+		t.Fatal(req)
+	}
+	if _, err := registry.Render("parking", "", map[string]interface{}{"plate": "沪A12345", "amount": 1250}); err == nil {
+		t.Fatal("untyped amount accepted")
+	}
+	if err := registry.ValidateUrl("https://example.com"); err == nil {
+		t.Fatal("url outside whitelist accepted")
+	}
+	if err := ValidateMessageContent("支付成功😀"); err == nil {
+		t.Fatal("emoji accepted")
+	}
+}
+
 func TestUnionPayApp_PushMessage(t *testing.T) {
 	res, err := account.PushMessage(&PushMessageReq{
 		OpenId:  "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
@@ -72,3 +703,437 @@ func TestUnionPayApp_PushMessage(t *testing.T) {
 	}
 	t.Log("res", res)
 }
+
+func TestPushMessageResult_UnmarshalJSON(t *testing.T) {
+	var res PushMessageResult
+	if err := json.Unmarshal([]byte(`{"msgId":20240326000001,"status":"1"}`), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.MsgId != "20240326000001" || res.Extra["status"] != "1" {
+		t.Fatal(res)
+	}
+}
+
+func TestUnionPayApp_PushMessageMsgId(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"resp":"00","params":{"msgId":1234567890123456789}}`))
+	}))
+	defer server.Close()
+	defer func(push string) {
+		SDKConfig["PushMessage"] = push
+	}(SDKConfig["PushMessage"])
+	SDKConfig["PushMessage"] = server.URL
+
+	app := &UnionPayApp{
+		Config:       &Config{AppId: account.AppId, Logger: account.Logger},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	res, err := app.PushMessage(&PushMessageReq{OpenId: "1", Content: "测试消息2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MsgId != "1234567890123456789" {
+		t.Fatal(res.MsgId)
+	}
+}
+
+func TestUnionPayApp_PushBatch(t *testing.T) {
+	summary, err := account.PushBatch(context.Background(), PushRecipients(context.Background(), []*PushMessageReq{
+		{
+			OpenId:  "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
+			Content: "测试消息3",
+			Url:     "https://unionpay-notice.eioos.com",
+		},
+	}), &PushBatchOptions{
+		Workers:       2,
+		RatePerSecond: 10,
+		OnResult: func(result *PushResult) {
+			t.Log("result", result)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	t.Log("summary", summary)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: time.Minute * 2, 6: time.Minute * 32, 7: time.Hour, 70: time.Hour} {
+		if d := retryBackoff(nil, attempts); d != want {
+			t.Fatal(attempts, d)
+		}
+	}
+	if d := retryBackoff(func(attempts int) time.Duration { return time.Second * time.Duration(attempts) }, 3); d != time.Second*3 {
+		t.Fatal(d)
+	}
+}
+
+// requireRedis skips a test using the Redis of account when it can not be
+// reached.
+func requireRedis(t *testing.T) {
+	if account.Redis == nil || account.Redis.Ping(context.Background()).Err() != nil {
+		t.Skip("redis not available")
+	}
+}
+
+func TestPushQueue(t *testing.T) {
+	requireRedis(t)
+	rds := account.Redis
+	ctx := context.Background()
+	var lock sync.Mutex
+	pushed := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		openId, _ := body["openId"].(string)
+		lock.Lock()
+		pushed[openId]++
+		lock.Unlock()
+		if openId == "fail" {
+			w.Write([]byte(`{"resp":"99","msg":"推送失败"}`))
+			return
+		}
+		w.Write([]byte(`{"resp":"00","params":{"msgId":"1"}}`))
+	}))
+	defer server.Close()
+	defer func(push string) {
+		SDKConfig["PushMessage"] = push
+	}(SDKConfig["PushMessage"])
+	SDKConfig["PushMessage"] = server.URL
+	pushes := func(openId string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return pushed[openId]
+	}
+
+	appId, _ := randomHex(8)
+	app := &UnionPayApp{
+		Config:       &Config{AppId: "test-" + appId, Logger: account.Logger, Redis: rds},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	queue := &PushQueue{App: app, MaxAttempts: 2, Backoff: func(int) time.Duration { return -time.Second }}
+	defer rds.Del(ctx, queue.keys()...)
+
+	now := time.Now()
+	if _, err := queue.Schedule(ctx, now.Add(-time.Second), &PushMessageReq{OpenId: "due", Content: "测试消息6"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Schedule(ctx, now.Add(-time.Second), &PushMessageReq{OpenId: "fail", Content: "测试消息6"}); err != nil {
+		t.Fatal(err)
+	}
+	later, err := queue.Schedule(ctx, now.Add(time.Hour), &PushMessageReq{OpenId: "later", Content: "测试消息6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := queue.Cancel(ctx, later); err != nil || !ok {
+		t.Fatal("cancel", ok, err)
+	}
+	if ok, _ := queue.Cancel(ctx, later); ok {
+		t.Fatal("cancelled twice")
+	}
+
+	if err := queue.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pushes("due") != 1 || pushes("fail") != 2 || pushes("later") != 0 {
+		t.Fatal(pushes("due"), pushes("fail"), pushes("later"))
+	}
+	dead, err := queue.DeadLetters(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].OpenId != "fail" || dead[0].Attempts != 2 || dead[0].LastError == "" {
+		t.Fatal(dead)
+	}
+
+	// a message whose lease ran out is restored and pushed by the next poll
+	if _, err := queue.Schedule(ctx, now.Add(-time.Second), &PushMessageReq{OpenId: "lost", Content: "测试消息6"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := pushQueueClaim.Run(ctx, rds, queue.keys(), now.UnixMilli(), 1, now.Add(-time.Millisecond).UnixMilli()).StringSlice()
+	if err != nil || len(ids) != 1 {
+		t.Fatal(ids, err)
+	}
+	if err := queue.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pushes("lost") != 1 {
+		t.Fatal(pushes("lost"))
+	}
+	if n, _ := rds.ZCard(ctx, queue.keys()[0]).Result(); n != 0 {
+		t.Fatal("due set not empty", n)
+	}
+	if n, _ := rds.HLen(ctx, queue.keys()[2]).Result(); n != 0 {
+		t.Fatal("messages left", n)
+	}
+}
+
+func TestMemoryOutboxStore(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	ctx := context.Background()
+	req := &PushMessageReq{
+		OpenId:  "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
+		Content: "测试消息4",
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := NewOutboxMessage("order-202403260001", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Enqueue(ctx, nil, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	pending, err := store.Claim(ctx, now, 10, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatal("duplicate enqueued", len(pending))
+	}
+	if claimed, _ := store.Claim(ctx, now, 10, now.Add(time.Minute)); len(claimed) != 0 {
+		t.Fatal("claimed twice", claimed)
+	}
+	if claimed, _ := store.Claim(ctx, now.Add(time.Minute*2), 10, now.Add(time.Minute*3)); len(claimed) != 1 {
+		t.Fatal("lease not expired", claimed)
+	}
+
+	pending[0].Status = OutboxSent
+	if err := store.Update(ctx, pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := store.Get(ctx, pending[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != OutboxSent {
+		t.Fatal(msg)
+	}
+	if pending, _ := store.Claim(ctx, now.Add(time.Hour), 10, now.Add(time.Hour)); len(pending) != 0 {
+		t.Fatal(pending)
+	}
+}
+
+func TestPushPolicy_QuietHours(t *testing.T) {
+	policy := &PushPolicy{App: &account, QuietFrom: time.Hour * 22, QuietTo: time.Hour * 8}
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	until, ok := policy.quietUntil(time.Date(2024, 3, 26, 23, 30, 0, 0, loc))
+	if !ok || !until.Equal(time.Date(2024, 3, 27, 8, 0, 0, 0, loc)) {
+		t.Fatal(until, ok)
+	}
+	until, ok = policy.quietUntil(time.Date(2024, 3, 27, 7, 59, 0, 0, loc))
+	if !ok || !until.Equal(time.Date(2024, 3, 27, 8, 0, 0, 0, loc)) {
+		t.Fatal(until, ok)
+	}
+	if _, ok := policy.quietUntil(time.Date(2024, 3, 27, 12, 0, 0, 0, loc)); ok {
+		t.Fatal("noon in quiet hours")
+	}
+
+	policy.RequireAuthorized = true
+	policy.Authorized = func(ctx context.Context, openId string) (bool, error) {
+		return openId == "1", nil
+	}
+	decision, err := policy.Push(context.Background(), &PushMessageReq{OpenId: "2", Content: "测试消息7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Sent || decision.Reason != PushBlockUnauthorized {
+		t.Fatal(decision)
+	}
+}
+
+func TestNormalizeJsApiUrl(t *testing.T) {
+	res, err := NormalizeJsApiUrl("HTTPS://Unionpay-Notice.eioos.com:443/pay?plate=沪A12345&from=%e4%ba%91#/detail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "https://unionpay-notice.eioos.com/pay?plate=%E6%B2%AAA12345&from=%e4%ba%91" {
+		t.Fatal(res)
+	}
+	if quoted, _ := NormalizeJsApiUrl("https://unionpay-notice.eioos.com/pay?name=o'neil&q=`a`"); quoted != "https://unionpay-notice.eioos.com/pay?name=o%27neil&q=`a`" {
+		t.Fatal(quoted)
+	}
+	if _, err := NormalizeJsApiUrl("/pay"); err == nil {
+		t.Fatal("relative url accepted")
+	}
+
+	config := &JsApiConfig{AppId: account.AppId, Timestamp: 1711425600, NonceStr: "a1b2c3d4e5"}
+	config.Signature = jsApiSignature(JsApiSignString(config.AppId, "frontToken", config.NonceStr, config.Timestamp, res))
+	if !VerifyJsApiSignature(config, "frontToken", "https://unionpay-notice.eioos.com/pay?plate=沪A12345&from=%e4%ba%91#top") {
+		t.Fatal("signature mismatch")
+	}
+	if VerifyJsApiSignature(config, "frontToken", "https://unionpay-notice.eioos.com/pay") {
+		t.Fatal("signature of another url accepted")
+	}
+
+	nonce, err := randomNonce(JsApiNonceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonce) != JsApiNonceLength || strings.Trim(nonce, nonceChars) != "" {
+		t.Fatal(nonce)
+	}
+}
+
+func TestJsApiConfigHandler(t *testing.T) {
+	handler := &JsApiConfigHandler{
+		Accounts:       &Accounts{},
+		AllowedDomains: map[string][]string{account.AppId: {".eioos.com"}},
+	}
+
+	r := httptest.NewRequest(http.MethodOptions, "/jsapi/config", nil)
+	r.Header.Set("Origin", "https://unionpay-notice.eioos.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://unionpay-notice.eioos.com" {
+		t.Fatal(w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/jsapi/config", strings.NewReader(`{"appId":"`+account.AppId+`","url":"https://example.com/pay"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Origin", "https://example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal(w.Code, w.Header())
+	}
+	t.Log(w.Body.String())
+}
+
+func TestJsApiScript(t *testing.T) {
+	config := &JsApiConfig{AppId: account.AppId, Timestamp: 1711425600, NonceStr: "a1b2c3d4e5", Signature: "</script>", JsApiList: []string{"scanCode"},
+		Url: "https://unionpay-notice.eioos.com/pay", SignString: "appId=" + account.AppId + "&frontToken=frontToken"}
+	res, err := JsApiScript(config, &JsApiScriptOptions{Nonce: "r4nd0m", Ready: "app.onReady", Error: "onError"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(res)
+	if !strings.Contains(html, `src="https://open.95516.com/s/open/js/upsdk.js" nonce="r4nd0m"`) ||
+		!strings.Contains(html, "app.onReady();") ||
+		!strings.Contains(html, "onError(err);") ||
+		strings.Contains(html, "</script>\"") ||
+		strings.Contains(html, "frontToken") || strings.Contains(html, "signString") {
+		t.Fatal(html)
+	}
+	if config.SignString == "" {
+		t.Fatal("config changed")
+	}
+	t.Log(html)
+
+	if _, err := JsApiScript(config, &JsApiScriptOptions{Ready: "alert(1)"}); err == nil {
+		t.Fatal("callback expression accepted")
+	}
+}
+
+func TestUnionPayApp_contractApplyDuplicate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/contract.apply":
+			w.Write([]byte(`{"resp":"99","msg":"重复签约"}`))
+		case "/contract.info":
+			w.Write([]byte(`{"resp":"00","params":{"contractId":"6218400000084452092","contractStatus":"1","contractCode":"20240326000000000000000000000001","signTime":"20240326120000"}}`))
+		}
+	}))
+	defer server.Close()
+	defer func(apply string, info string) {
+		SDKConfig["ContractApply"], SDKConfig["ContractInfo"] = apply, info
+	}(SDKConfig["ContractApply"], SDKConfig["ContractInfo"])
+	SDKConfig["ContractApply"] = server.URL + "/contract.apply"
+	SDKConfig["ContractInfo"] = server.URL + "/contract.info"
+
+	app := &UnionPayApp{
+		Config:       &Config{AppId: account.AppId, PlanId: account.PlanId, Logger: account.Logger},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	res, err := app.contractApply(&ContractApplyReq{
+		OpenId:       "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
+		ContractCode: "20240326000000000000000000000001",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ContractId != "6218400000084452092" || res.OperateTime != "20240326120000" {
+		t.Fatal(res)
+	}
+
+	if _, err := app.contractApply(&ContractApplyReq{
+		OpenId:       "neFzPSlKkkFIlOGWSu5jYMGTSJWxD4zttwlPi3lIxAuj5Cdy1fjBGnXUPBoZo0XE",
+		ContractCode: "20240326000000000000000000000002",
+	}); RespCode(err) != "99" {
+		t.Fatal("contract of another contractCode accepted", err)
+	}
+}
+
+func TestUnionPayApp_PushBatchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recipients := make(chan *PushMessageReq, 2)
+	recipients <- &PushMessageReq{OpenId: "1", Content: "测试消息5"}
+	recipients <- &PushMessageReq{OpenId: "2", Content: "测试消息5"}
+	close(recipients)
+
+	var progress []*PushBatchSummary
+	time.AfterFunc(time.Millisecond*50, cancel)
+	summary, err := account.PushBatch(ctx, recipients, &PushBatchOptions{
+		Workers:       2,
+		RatePerSecond: 1,
+		OnProgress: func(summary *PushBatchSummary) {
+			progress = append(progress, summary)
+		},
+	})
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	if summary.Total != 2 || summary.Failed != 2 {
+		t.Fatal(summary)
+	}
+	if len(progress) != 2 || progress[0].Total != 1 {
+		t.Fatal("progress shares the summary", progress[0])
+	}
+}
+
+func TestUnionPayApp_PushBatchCancelled(t *testing.T) {
+	var lock sync.Mutex
+	pushed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		pushed++
+		lock.Unlock()
+		w.Write([]byte(`{"resp":"00","params":{"msgId":"1"}}`))
+	}))
+	defer server.Close()
+	defer func(push string) {
+		SDKConfig["PushMessage"] = push
+	}(SDKConfig["PushMessage"])
+	SDKConfig["PushMessage"] = server.URL
+
+	app := &UnionPayApp{
+		Config:       &Config{AppId: account.AppId, Logger: account.Logger},
+		backendToken: &BackendToken{BackendToken: "backendToken"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 20; i++ {
+		recipients := make(chan *PushMessageReq, 4)
+		for j := 0; j < 4; j++ {
+			recipients <- &PushMessageReq{OpenId: fmt.Sprint(j), Content: "测试消息5"}
+		}
+		close(recipients)
+		summary, err := app.PushBatch(ctx, recipients, &PushBatchOptions{Workers: 2})
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+		if summary.Succeeded != 0 || summary.Failed != summary.Total {
+			t.Fatal(summary)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if pushed != 0 {
+		t.Fatal("pushed after cancelling", pushed)
+	}
+}
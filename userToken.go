@@ -0,0 +1,178 @@
+package unionPayApp
+
+import (
+	"context"
+	"encoding/json"
+	baseError "github.com/go-tron/base-error"
+	"github.com/go-tron/local-time"
+	"github.com/go-tron/redis"
+	"time"
+)
+
+const (
+	UserTokenPrefix     = "upa-user-token:"
+	UserTokenLockPrefix = "upa-user-token-lock:"
+)
+
+var (
+	// UserTokenTTL is how long a user token is kept in the store, it should
+	// cover the lifetime of the refresh token.
+	UserTokenTTL = time.Hour * 24 * 30
+	// UserTokenRefreshAhead refreshes the access token this long before it expires.
+	UserTokenRefreshAhead = time.Minute
+	// RefreshTokenInvalidCodes are the resp codes of RefreshOAuthToken that
+	// mean the refresh token is invalid or expired, the stored token is
+	// dropped and the user has to authorise again. Any other resp code also
+	// asks to authorise again once the access token has expired, but keeps
+	// the token for the next attempt, and so do errors without a resp code
+	// such as timeouts.
+	RefreshTokenInvalidCodes = []string{}
+)
+
+var (
+	ErrorReauthorize = baseError.System("3106", "云闪付用户需重新授权")
+)
+
+func (upa *UnionPayApp) userTokenKey(openId string) string {
+	return UserTokenPrefix + upa.AppId + ":" + openId
+}
+
+func (upa *UnionPayApp) SaveUserToken(ctx context.Context, token *OAuthToken) error {
+	if token == nil || token.OpenId == "" {
+		return ErrorParam("openId")
+	}
+	if token.ExpiresAt == 0 {
+		token.ExpiresAt = localTime.Now().Unix() + token.ExpiresIn
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return upa.Redis.Set(ctx, upa.userTokenKey(token.OpenId), string(data), UserTokenTTL).Err()
+}
+
+func (upa *UnionPayApp) GetUserToken(ctx context.Context, openId string) (*OAuthToken, error) {
+	data, err := upa.Redis.Get(ctx, upa.userTokenKey(openId)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token = &OAuthToken{}
+	if err := json.Unmarshal([]byte(data), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (upa *UnionPayApp) DeleteUserToken(ctx context.Context, openId string) error {
+	return upa.Redis.Del(ctx, upa.userTokenKey(openId)).Err()
+}
+
+func (upa *UnionPayApp) GetValidAccessToken(ctx context.Context, openId string) (string, error) {
+	lockKey := UserTokenLockPrefix + upa.AppId + ":" + openId
+	secret, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < 50; i++ {
+		token, valid, err := upa.validUserToken(ctx, openId)
+		if err != nil || valid {
+			return accessToken(token), err
+		}
+
+		if !upa.Redis.LockWithSecret(ctx, lockKey, secret, 10) {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(time.Millisecond * 100):
+			}
+			continue
+		}
+		// another pod may have refreshed between our read and the lock, the
+		// refresh token read before it may be spent already
+		token, valid, err = upa.validUserToken(ctx, openId)
+		if err != nil || valid {
+			upa.Redis.UnlockWithSecret(ctx, lockKey, secret)
+			return accessToken(token), err
+		}
+		res, err := upa.refreshUserToken(ctx, token)
+		upa.Redis.UnlockWithSecret(ctx, lockKey, secret)
+		return res, err
+	}
+	return "", ErrorAuthorize
+}
+
+// validUserToken reports whether the stored token can be used without a
+// refresh, it fails with ErrorReauthorize when it can not be refreshed.
+func (upa *UnionPayApp) validUserToken(ctx context.Context, openId string) (*OAuthToken, bool, error) {
+	token, err := upa.GetUserToken(ctx, openId)
+	if err != nil {
+		return nil, false, err
+	}
+	if token == nil || (token.AccessToken == "" && token.RefreshToken == "") {
+		return nil, false, ErrorReauthorize
+	}
+	if token.ExpiresAt-int64(UserTokenRefreshAhead/time.Second) > localTime.Now().Unix() {
+		return token, true, nil
+	}
+	if token.RefreshToken == "" {
+		return nil, false, ErrorReauthorize
+	}
+	return token, false, nil
+}
+
+func accessToken(token *OAuthToken) string {
+	if token == nil {
+		return ""
+	}
+	return token.AccessToken
+}
+
+func isRefreshTokenInvalid(err error) bool {
+	code := RespCode(err)
+	for _, c := range RefreshTokenInvalidCodes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshUserToken refreshes token. The stored token is only dropped for
+// the resp codes of RefreshTokenInvalidCodes, on other errors an access
+// token that has not expired yet is still returned. Once it has expired a
+// refresh refused by the platform fails with ErrorReauthorize.
+func (upa *UnionPayApp) refreshUserToken(ctx context.Context, token *OAuthToken) (string, error) {
+	res, err := upa.RefreshOAuthToken(token.RefreshToken)
+	if err != nil {
+		upa.Logger.Error("RefreshOAuthToken", upa.Logger.Field("error", err), upa.Logger.Field("openId", token.OpenId))
+		if isRefreshTokenInvalid(err) {
+			if err := upa.DeleteUserToken(ctx, token.OpenId); err != nil {
+				return "", err
+			}
+			return "", ErrorReauthorize
+		}
+		if token.AccessToken != "" && token.ExpiresAt > localTime.Now().Unix() {
+			return token.AccessToken, nil
+		}
+		if RespCode(err) != "" {
+			return "", ErrorReauthorize
+		}
+		return "", err
+	}
+	if res.OpenId == "" {
+		res.OpenId = token.OpenId
+	}
+	if res.RefreshToken == "" {
+		res.RefreshToken = token.RefreshToken
+	}
+	if res.Scope == "" {
+		res.Scope = token.Scope
+	}
+	if err := upa.SaveUserToken(ctx, res); err != nil {
+		return "", err
+	}
+	return res.AccessToken, nil
+}